@@ -1,98 +1,788 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	mathbits "math/bits"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	_ "modernc.org/sqlite"
 )
 
 /* Default values */
 const (
-	ModeLocal                   Mode   = "local"
-	ModeRemote                  Mode   = "remote"
-	ServeModeFile               Mode   = "file"
-	ServeModeRedirect           Mode   = "redirect"
-	ServeModeLink               Mode   = "link"
-	ServeModeHtml               Mode   = "html"
-	DefaultConfigFileName       string = "config.json"
-	ConfigDefaultListenPort     int    = 8080
-	ConfigDefaultCacheFolder    string = "cache"
-	ConfigDefaultCacheTmpFolder string = "tmp"
-	ConfigDefaultUpdateInterval int64  = 3
-	ConfigDefaultMaxCacheSize   int    = 0 // 0 = unlimited
-	ConfigDefaultImageQuality   int    = 60
-	ConfigDefaultRemote1        string = "https://api.lolicon.app/setu/v2?r18=2"
-	ConfigDefaultRemote2        string = "https://sex.nyan.xyz/api/v2"
+	ModeLocal                             Mode    = "local"
+	ModeRemote                            Mode    = "remote"
+	ServeModeFile                         Mode    = "file"
+	ServeModeRedirect                     Mode    = "redirect"
+	ServeModeLink                         Mode    = "link"
+	ServeModeHtml                         Mode    = "html"
+	ServeModeJson                         Mode    = "json"
+	DefaultConfigFileName                 string  = "config.json"
+	Version                               string  = "1.0.0"
+	ConfigDefaultListenPort               int     = 8080
+	ConfigDefaultListenSocketMode         string  = "0660"
+	ConfigDefaultTLSListenPort            int     = 8443
+	ConfigDefaultACMECacheFolder          string  = "acme"
+	ACMEChallengePort                     int     = 80 // HTTP-01 challenges are always sent to port 80
+	ACMETLSListenPort                     int     = 443
+	ConfigDefaultPprofListenPort          int     = 6060 // Only listens on localhost
+	ConfigDefaultReadTimeoutSec           int     = 10   // 0 = no timeout
+	ConfigDefaultWriteTimeoutSec          int     = 120  // Covers synchronous remote retrieval, 0 = no timeout
+	ConfigDefaultIdleTimeoutSec           int     = 120  // 0 = no timeout
+	ConfigDefaultAccessLogFormat          string  = AccessLogFormatCombined
+	ConfigDefaultLogFormat                string  = LogFormatText
+	ConfigDefaultLogLevel                 string  = "info" // One of debug, info, warn, error
+	ConfigDefaultLogMaxSizeMB             int     = 100    // 0 = no rotation
+	ConfigDefaultLogMaxBackups            int     = 5      // 0 = keep all rotated files
+	ConfigDefaultLogMaxAgeDays            int     = 30     // 0 = keep rotated files regardless of age
+	LogBackupTimeFormat                   string  = "20060102-150405.000"
+	AccessLogFormatCombined               string  = "combined"
+	AccessLogFormatJSON                   string  = "json"
+	LogFormatText                         string  = "text"
+	LogFormatJSON                         string  = "json"
+	ConfigDefaultCacheFolder              string  = "cache"
+	ConfigDefaultCacheTmpFolder           string  = "tmp"
+	ConfigDefaultIndexFileName            string  = "index.json"
+	ConfigDefaultIndexBackend             string  = IndexBackendJSON
+	ConfigDefaultIndexDatabaseFileName    string  = "index.db" // Used by sqlite backend, which imports IndexFileName on first run
+	IndexBackendJSON                      string  = "json"
+	IndexBackendSQLite                    string  = "sqlite"
+	ConfigDefaultUpdateInterval           int64   = 3
+	ConfigDefaultBackgroundPrefetch       bool    = true // Only runs in remote mode with MaxCacheSize or MaxCacheSizeMB set
+	ConfigDefaultPrefetchConcurrency      int     = 2
+	ConfigDefaultMaxConcurrentRetrievals  int     = 2
+	ConfigDefaultMaxConcurrentRequests    int     = 256 // 0 = unlimited
+	ConfigDefaultMaxQueuedRequests        int     = 512
+	ConfigDefaultRequestQueueTimeoutSec   int     = 10
+	ConfigDefaultJanitorIntervalMinutes   int     = 60 // 0 = disabled
+	ConfigDefaultMaxCacheSize             int     = 0  // 0 = unlimited
+	ConfigDefaultMaxCacheSizeMB           int     = 0  // 0 = unlimited, takes precedence over MaxCacheSize
+	ConfigDefaultCacheTTLHours            int     = 0  // 0 = images never expire
+	ConfigDefaultNearDuplicateThreshold   int     = 0  // 0 = near-duplicates are cached
+	ConfigDefaultImageQuality             int     = 60
+	ConfigDefaultMaxImagePixels           int     = 0 // 0 = keep original resolution
+	ConfigDefaultMinWidth                 int     = 0 // 0 = no minimum
+	ConfigDefaultMinHeight                int     = 0 // 0 = no minimum
+	ConfigDefaultMaxCount                 int     = 10
+	ConfigDefaultMaxImagesPerResponse     int     = 1
+	ConfigDefaultRecentHistorySize        int     = 5
+	ConfigDefaultClientHistoryIdleMinutes int     = 30
+	ConfigDefaultRateLimitPerSecond       float64 = 0 // 0 = no rate limit
+	ConfigDefaultRateLimitBurst           int     = 10
+	ConfigDefaultMaxDownloadSizeMB        int     = 0 // 0 = unlimited
+	ConfigDefaultRemoteTimeoutSec         int     = 30
+	ConfigDefaultMaxRedirects             int     = 10
+	ConfigDefaultUserAgent                string  = "ImgAPICacher-Go/" + Version
+	ConfigDefaultRemoteFailureThreshold   int     = 3
+	ConfigDefaultRemoteCooldownMin        int     = 10
+	ConfigDefaultBlockPrivateImageHosts   bool    = true
+	ConfigDefaultStripMetadata            bool    = true
+	ConfigDefaultBasicAuthExemptHealth    bool    = true
+	ConfigDefaultDefaultFavicon           bool    = true // Built-in icon is served if FaviconFile is not set
+	ConfigDefaultAllowedOrigin            string  = "*"
+	ConfigDefaultCacheControlMaxAge       int     = 0 // 0 = no caching headers
+	ConfigDefaultRemote1                  string  = "https://api.lolicon.app/setu/v2?r18=2"
+	ConfigDefaultRemote2                  string  = "https://sex.nyan.xyz/api/v2"
+	ConfigDefaultRemoteWeight             float64 = 1
+	MaxResizeWidth                        int     = 4096
+	MaxResizeHeight                       int     = 4096
+	LargeImagePixels                      int     = 12000000 // Larger images are decoded one at a time
+	OrientationLandscape                  string  = "landscape"
+	OrientationPortrait                   string  = "portrait"
+	OrientationSquare                     string  = "square"
+	SquareTolerancePercent                int     = 5 // Aspect ratios within this percentage of 1:1 count as square
+	MaxOrientationRetries                 int     = 5
+	MaxIdleConnsPerRemote                 int     = 4
+	MaxPrefetchCount                      int     = 1000
+	DefaultPrefetchCount                  int     = 10
+	MaxTopImages                          int     = 1000
+	GalleryPageSize                       int     = 50
+	GalleryThumbnailWidth                 int     = 240
+	MaxRecentErrors                       int     = 50 // Errors shown on /status
+	StatusRefreshSeconds                  int     = 30
+	UploadFolder                          string  = "upload" // Subfolder of cache folder or category folder for uploaded images
+	MaxUploadFiles                        int     = 100
+	UploadMemoryMB                        int     = 32 // Larger multipart uploads are buffered on disk
+	DefaultTopImages                      int     = 20
+	RetrievalWaitMillis                   int     = 100   // Background retrievals give up after this wait for a free slot
+	BusyRetryAfterSeconds                 int     = 5     // Suggested to clients waiting for a busy remote retrieval
+	StaleTmpFileMinutes                   int     = 60    // Files in tmp folder older than this are left over from crashes
+	EvictionGraceMinutes                  int     = 60    // Images never served are only evicted first once older than this
+	IndexSaveSeconds                      int     = 60    // Changes of image index are saved to index file at most this often
+	CacheListingRefreshSeconds            int     = 60    // Cache folder is listed again in background this often to notice files changed by others
+	MaxPickAttempts                       int     = 3     // Picks are repeated this often when picked files turn out to be missing
+	MaxClientHistories                    int     = 1000  // Least recently active clients are forgotten beyond this
+	MaxRateLimitClients                   int     = 10000 // Least recently active clients are forgotten beyond this
+	ShutdownTimeoutSeconds                int     = 30    // Requests in progress get this long to finish on shutdown
+	ClientCookieName                      string  = "ImgAPICacherClient"
+	RequestIDHeader                       string  = "X-Request-ID"
+	MaxRequestIDLength                    int     = 64 // Longer incoming request IDs are replaced by generated ones
+	FaviconMaxAgeSeconds                  int     = 604800
+	ImageIndexVersion                     int     = 6 // Increase when analyzed fields of ImageInfo change
+	ImageIDLength                         int     = 10
+	CacheFilenameHashLength               int     = 16
+	BlurHashXComponents                   int     = 4
+	BlurHashYComponents                   int     = 3
+	BlurHashSampleSize                    int     = 64
+	PerceptualHashBits                    int     = 64
+	DefaultNearDuplicateThreshold         int     = 6 // Used by /near-duplicates when NearDuplicateThreshold is 0
 )
 
+// Headers of remotes that are shown in logs, values of all others are redacted
+var PublicHeaders = []string{"Accept", "Accept-Language", "Origin", "Referer", "User-Agent"}
+
+// Sizes requested widths and heights are rounded up to, so each image has only a few resized variants
+var ResizeSizes = []int{64, 128, 256, 512, 1024, 2048, MaxResizeWidth}
+
 /* Custom types/structs */
 type Mode string
+type ImageInfo struct {
+	Version       int
+	ID            string
+	Width         int
+	Height        int
+	Format        string
+	Size          int64
+	Hash          string
+	ModTime       time.Time
+	CachedAt      time.Time
+	DominantColor string
+	BlurHash      string
+	PHash         string
+	OriginalName  string
+	SourceRemote  string
+	SourceURL     string
+	LastServed    time.Time
+	ServeCount    int64
+}
+type ImageIndex interface {
+	Get(filename string) (ImageInfo, bool)
+	GetByID(id string) (string, bool)
+	GetByHash(hash string) []string
+	Update(filename string, create bool, update func(info *ImageInfo)) (ImageInfo, bool)
+	MarkServed(filenames []string, servedAt time.Time)
+	Remove(filename string)
+	Clear()
+	Range(fn func(filename string, info ImageInfo) bool)
+	Find(filter ImageFilter) []string
+	Sample(filter ImageFilter, n int, exclude func(filename string) bool) []string
+	Oldest(n int) []string
+	Flush() error
+	Close() error
+}
+type ImageFilter struct {
+	Category     string
+	Quality      int
+	Orientation  string
+	CachedAfter  time.Time
+	CachedBefore time.Time
+}
+type JSONImageIndex struct {
+	FileName string
+	Images   map[string]*ImageInfo
+	IDs      map[string]string
+	Dirty    bool
+	Lock     sync.Mutex
+}
+type SQLiteImageIndex struct {
+	FileName string
+	DB       *sql.DB
+}
+type ImageRequest struct {
+	BaseURL     string
+	Quality     int
+	ServeMode   Mode
+	Orientation string
+	Seed        string
+	Client      string
+	Category    string
+	Count       int
+	List        bool
+}
+type ImageResponse struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	Size          int64     `json:"size"`
+	Format        string    `json:"format"`
+	CachedAt      time.Time `json:"cached_at"`
+	DominantColor string    `json:"dominant_color"`
+	BlurHash      string    `json:"blurhash"`
+}
+type CacheInfoResponse struct {
+	ID           string    `json:"id"`
+	Filename     string    `json:"filename"`
+	URL          string    `json:"url"`
+	SourceRemote string    `json:"source_remote"`
+	SourceURL    string    `json:"source_url"`
+	OriginalName string    `json:"original_name"`
+	CachedAt     time.Time `json:"cached_at"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Size         int64     `json:"size"`
+	Format       string    `json:"format"`
+	Hash         string    `json:"hash"`
+}
+type NearDuplicateCluster struct {
+	Kept       string   `json:"kept"`
+	Duplicates []string `json:"duplicates"`
+}
+type GalleryImage struct {
+	Filename     string
+	ImageURL     string
+	ThumbnailURL string
+	Size         string
+	Age          string
+}
+type GalleryPage struct {
+	Images     []GalleryImage
+	Total      int
+	Page       int
+	Pages      int
+	PrevURL    string
+	NextURL    string
+	FormAction string
+}
+type UploadRequest struct {
+	URLs []string `json:"urls"`
+}
+type UploadResult struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+type PurgeResult struct {
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	OlderThan string `json:"older_than,omitempty"`
+}
+type ImageStats struct {
+	Filename   string    `json:"filename"`
+	ID         string    `json:"id"`
+	ServeCount int64     `json:"serve_count"`
+	LastServed time.Time `json:"last_served"`
+}
+type TopImagesResponse struct {
+	MostServed  []ImageStats `json:"most_served"`
+	LeastServed []ImageStats `json:"least_served"`
+}
+type StatsResponse struct {
+	CachedImages     int            `json:"cached_images"`
+	CachedFiles      int            `json:"cached_files"`
+	CacheBytes       int64          `json:"cache_bytes"`
+	Mode             Mode           `json:"mode"`
+	EffectiveMode    Mode           `json:"effective_mode"`
+	LastRemoteFetch  time.Time      `json:"last_remote_fetch"`
+	ServedFromCache  int64          `json:"served_from_cache"`
+	RemoteFetches    int64          `json:"remote_fetches"`
+	InFlightRequests int64          `json:"in_flight_requests"`
+	QueuedRequests   int64          `json:"queued_requests"`
+	RejectedRequests int64          `json:"rejected_requests"`
+	Remotes          []RemoteHealth `json:"remotes"`
+	StartedAt        time.Time      `json:"started_at"`
+	UptimeSeconds    int64          `json:"uptime_seconds"`
+}
+type HealthResponse struct {
+	Status string          `json:"status"`
+	Checks map[string]bool `json:"checks"`
+}
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+type LogWriter struct {
+	Handler slog.Handler
+}
+type RotatingFile struct {
+	FileName   string
+	MaxSize    int64
+	MaxBackups int
+	MaxAge     time.Duration
+	File       *os.File
+	Size       int64
+	Lock       sync.Mutex
+}
+type RecentErrorsHandler struct {
+	slog.Handler
+}
+type RecentError struct {
+	Time    time.Time
+	Message string
+}
+type StatusPage struct {
+	Version         string
+	StartedAt       time.Time
+	Uptime          string
+	Mode            Mode
+	EffectiveMode   Mode
+	CachedImages    int
+	MaxCacheSize    int
+	CacheSize       string
+	MaxCacheSizeMB  int
+	LastRemoteFetch time.Time
+	Remotes         []RemoteHealth
+	Errors          []RecentError
+	Config          string
+	RefreshSeconds  int
+}
+type TextLogHandler struct {
+	Output io.Writer
+	Lock   *sync.Mutex
+	Attrs  []slog.Attr
+	Group  string
+}
+type TokenBucket struct {
+	Tokens   float64
+	LastSeen time.Time
+}
+type ClientHistory struct {
+	Served   map[string]bool
+	LastSeen time.Time
+}
+type Remote struct {
+	URL            string
+	Category       string `json:",omitempty"`
+	Weight         float64
+	Headers        map[string]string `json:",omitempty"`
+	Selector       string            `json:",omitempty"`
+	Method         string            `json:",omitempty"`
+	Body           json.RawMessage   `json:",omitempty"`
+	Base64         bool              `json:",omitempty"`
+	Proxy          string            `json:",omitempty"`
+	UpdateInterval int64             `json:",omitempty"` // 0 = UpdateInterval in config
+}
+type RemoteInfo struct {
+	Remote
+	Health RemoteHealth
+}
+type RetrievalCall struct {
+	Done     chan struct{}
+	Filename string
+	Acquired bool
+}
+type PrefetchResult struct {
+	Requested  int `json:"requested"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+	Duplicates int `json:"duplicates"`
+	Skipped    int `json:"skipped"`
+}
+type RemoteHealth struct {
+	URL                 string    `json:"url"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+	UnhealthyUntil      time.Time `json:"unhealthy_until"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+}
+type proxyContextKey struct{}
+type loggerContextKey struct{}
 type Config struct {
-	ListenPort     int
-	LogFileName    string
-	Mode           Mode
-	ServeMode      Mode
-	CacheFolder    string
-	CacheTmpFolder string
-	UpdateInterval int64
-	MaxCacheSize   int
-	ImageQuality   int
-	Remotes        []string
+	ListenPort               int
+	ListenAddress            string
+	ListenSocket             string
+	ListenSocketMode         string
+	TLSListenPort            int
+	TLSCertFile              string
+	TLSKeyFile               string
+	ACMEDomains              []string
+	ACMECacheFolder          string
+	ACMEEmail                string
+	ReadTimeoutSec           int
+	WriteTimeoutSec          int
+	IdleTimeoutSec           int
+	EnablePprof              bool
+	PprofListenPort          int
+	LogFileName              string
+	LogFormat                string
+	LogLevel                 string
+	LogMaxSizeMB             int
+	LogMaxBackups            int
+	LogMaxAgeDays            int
+	AccessLogFileName        string
+	AccessLogFormat          string
+	TrustedProxies           []string
+	AdminToken               string
+	BasicAuthUser            string
+	BasicAuthPassword        string
+	BasicAuthExemptHealth    *bool
+	Mode                     Mode
+	ServeMode                Mode
+	BaseURL                  string
+	AllowedHosts             []string
+	RobotsFile               string
+	FaviconFile              string
+	DefaultFavicon           *bool
+	PathPrefix               string
+	CacheFolder              string
+	CacheTmpFolder           string
+	IndexFileName            string
+	IndexBackend             string
+	IndexDatabaseFileName    string
+	UpdateInterval           int64
+	BackgroundPrefetch       *bool
+	PrefetchConcurrency      int
+	MaxConcurrentRetrievals  int
+	MaxConcurrentRequests    int
+	MaxQueuedRequests        int
+	RequestQueueTimeoutSec   int
+	JanitorIntervalMinutes   int
+	MaxCacheSize             int
+	MaxCacheSizeMB           int
+	SwitchToLocalWhenFull    bool
+	CacheTTLHours            int
+	NearDuplicateThreshold   int
+	ImageQuality             int
+	ProgressiveJPEG          bool
+	MaxImagePixels           int
+	MinWidth                 int
+	MinHeight                int
+	MaxDownloadSizeMB        int
+	RemoteTimeoutSec         int
+	MaxRedirects             int
+	UserAgent                string
+	Proxy                    string
+	AllowedImageDomains      []string
+	BlockedImageDomains      []string
+	BlockPrivateImageHosts   *bool
+	RemoteFailureThreshold   int
+	RemoteCooldownMin        int
+	ValidateRemotesOnStart   bool
+	RequireValidRemote       bool
+	MaxCount                 int
+	MaxImagesPerResponse     int
+	RecentHistorySize        int
+	ClientHistoryIdleMinutes int
+	RateLimitPerSecond       float64
+	RateLimitBurst           int
+	StripMetadata            *bool
+	AllowedOrigins           []string
+	CacheControlMaxAge       int
+	Remotes                  []Remote
 }
 
 /* Helper functions */
 
-// Function for standardize config reading/creating
-func newConfig(config Config) Config {
+// Function for getting pointer of a bool value (used for optional config values)
+func newBool(value bool) *bool {
+	return &value
+}
+
+// Function for standardize config reading/creating, returns error for config that must not be used
+func newConfig(config Config) (Config, error) {
 	// Create new config
 	newConfig := Config{
-		ListenPort:     ConfigDefaultListenPort,
-		Mode:           ModeRemote,
-		ServeMode:      ServeModeFile,
-		CacheFolder:    ConfigDefaultCacheFolder,
-		CacheTmpFolder: ConfigDefaultCacheTmpFolder,
-		UpdateInterval: ConfigDefaultUpdateInterval,
-		MaxCacheSize:   ConfigDefaultMaxCacheSize,
-		ImageQuality:   ConfigDefaultImageQuality,
-		Remotes:        []string{ConfigDefaultRemote1, ConfigDefaultRemote2},
+		ListenPort:               ConfigDefaultListenPort,
+		ListenSocketMode:         ConfigDefaultListenSocketMode,
+		TLSListenPort:            ConfigDefaultTLSListenPort,
+		ACMECacheFolder:          ConfigDefaultACMECacheFolder,
+		AccessLogFormat:          ConfigDefaultAccessLogFormat,
+		LogFormat:                ConfigDefaultLogFormat,
+		LogLevel:                 ConfigDefaultLogLevel,
+		LogMaxSizeMB:             ConfigDefaultLogMaxSizeMB,
+		LogMaxBackups:            ConfigDefaultLogMaxBackups,
+		LogMaxAgeDays:            ConfigDefaultLogMaxAgeDays,
+		PprofListenPort:          ConfigDefaultPprofListenPort,
+		ReadTimeoutSec:           ConfigDefaultReadTimeoutSec,
+		WriteTimeoutSec:          ConfigDefaultWriteTimeoutSec,
+		IdleTimeoutSec:           ConfigDefaultIdleTimeoutSec,
+		Mode:                     ModeRemote,
+		ServeMode:                ServeModeFile,
+		CacheFolder:              ConfigDefaultCacheFolder,
+		CacheTmpFolder:           ConfigDefaultCacheTmpFolder,
+		IndexFileName:            ConfigDefaultIndexFileName,
+		IndexBackend:             ConfigDefaultIndexBackend,
+		IndexDatabaseFileName:    ConfigDefaultIndexDatabaseFileName,
+		UpdateInterval:           ConfigDefaultUpdateInterval,
+		BackgroundPrefetch:       newBool(ConfigDefaultBackgroundPrefetch),
+		PrefetchConcurrency:      ConfigDefaultPrefetchConcurrency,
+		MaxConcurrentRetrievals:  ConfigDefaultMaxConcurrentRetrievals,
+		MaxConcurrentRequests:    ConfigDefaultMaxConcurrentRequests,
+		MaxQueuedRequests:        ConfigDefaultMaxQueuedRequests,
+		RequestQueueTimeoutSec:   ConfigDefaultRequestQueueTimeoutSec,
+		JanitorIntervalMinutes:   ConfigDefaultJanitorIntervalMinutes,
+		MaxCacheSize:             ConfigDefaultMaxCacheSize,
+		MaxCacheSizeMB:           ConfigDefaultMaxCacheSizeMB,
+		CacheTTLHours:            ConfigDefaultCacheTTLHours,
+		NearDuplicateThreshold:   ConfigDefaultNearDuplicateThreshold,
+		ImageQuality:             ConfigDefaultImageQuality,
+		StripMetadata:            newBool(ConfigDefaultStripMetadata),
+		BasicAuthExemptHealth:    newBool(ConfigDefaultBasicAuthExemptHealth),
+		DefaultFavicon:           newBool(ConfigDefaultDefaultFavicon),
+		AllowedOrigins:           []string{ConfigDefaultAllowedOrigin},
+		CacheControlMaxAge:       ConfigDefaultCacheControlMaxAge,
+		MinWidth:                 ConfigDefaultMinWidth,
+		MinHeight:                ConfigDefaultMinHeight,
+		MaxDownloadSizeMB:        ConfigDefaultMaxDownloadSizeMB,
+		RemoteTimeoutSec:         ConfigDefaultRemoteTimeoutSec,
+		MaxRedirects:             ConfigDefaultMaxRedirects,
+		UserAgent:                ConfigDefaultUserAgent,
+		RemoteFailureThreshold:   ConfigDefaultRemoteFailureThreshold,
+		RemoteCooldownMin:        ConfigDefaultRemoteCooldownMin,
+		BlockPrivateImageHosts:   newBool(ConfigDefaultBlockPrivateImageHosts),
+		MaxCount:                 ConfigDefaultMaxCount,
+		MaxImagesPerResponse:     ConfigDefaultMaxImagesPerResponse,
+		RecentHistorySize:        ConfigDefaultRecentHistorySize,
+		ClientHistoryIdleMinutes: ConfigDefaultClientHistoryIdleMinutes,
+		RateLimitPerSecond:       ConfigDefaultRateLimitPerSecond,
+		RateLimitBurst:           ConfigDefaultRateLimitBurst,
+		Remotes:                  []Remote{{URL: ConfigDefaultRemote1, Weight: ConfigDefaultRemoteWeight}, {URL: ConfigDefaultRemote2, Weight: ConfigDefaultRemoteWeight}},
 	}
 
 	// Check if any config values are invalid and replace them with default values
-	if config.ListenPort >= 1024 && config.ListenPort <= 65535 {
+	if (config.ListenPort >= 1024 && config.ListenPort <= 65535) || (config.ListenPort == 0 && (config.ListenSocket != "" || config.TLSCertFile != "" || len(config.ACMEDomains) > 0)) {
+		// Port 0 disables plain HTTP listening when serving on Unix socket or HTTPS only
 		newConfig.ListenPort = config.ListenPort
 	} else {
 		log.Println("Warning: ListenPort out of range, using default value " + strconv.Itoa(ConfigDefaultListenPort))
 	}
+	if address := strings.Trim(config.ListenAddress, "[]"); address == "" || net.ParseIP(address) != nil || regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`).MatchString(address) {
+		// Brackets of IPv6 addresses are added back when joining with port
+		newConfig.ListenAddress = address
+	} else {
+		log.Println("Warning: ListenAddress invalid, listening on all interfaces")
+	}
+	newConfig.ListenSocket = config.ListenSocket
+	if _, err := strconv.ParseUint(config.ListenSocketMode, 8, 32); err == nil {
+		newConfig.ListenSocketMode = config.ListenSocketMode
+	} else {
+		log.Println("Warning: ListenSocketMode invalid, using default value " + ConfigDefaultListenSocketMode)
+	}
+	if config.TLSListenPort >= 1024 && config.TLSListenPort <= 65535 && config.TLSListenPort != newConfig.ListenPort {
+		newConfig.TLSListenPort = config.TLSListenPort
+	} else {
+		log.Println("Warning: TLSListenPort out of range, using default value " + strconv.Itoa(ConfigDefaultTLSListenPort))
+	}
+	newConfig.EnablePprof = config.EnablePprof
+	if config.PprofListenPort >= 1024 && config.PprofListenPort <= 65535 && config.PprofListenPort != newConfig.ListenPort && config.PprofListenPort != newConfig.TLSListenPort {
+		newConfig.PprofListenPort = config.PprofListenPort
+	} else {
+		log.Println("Warning: PprofListenPort out of range, using default value " + strconv.Itoa(ConfigDefaultPprofListenPort))
+	}
+	if (config.TLSCertFile == "") == (config.TLSKeyFile == "") {
+		newConfig.TLSCertFile = config.TLSCertFile
+		newConfig.TLSKeyFile = config.TLSKeyFile
+	} else {
+		log.Println("Warning: Only one of TLSCertFile and TLSKeyFile set, disabling HTTPS")
+	}
+	for _, domain := range config.ACMEDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`).MatchString(domain) || net.ParseIP(domain) != nil {
+			log.Println("Warning: Domain " + domain + " in ACMEDomains invalid, skipping")
+			continue
+		}
+		newConfig.ACMEDomains = append(newConfig.ACMEDomains, domain)
+	}
+	if len(newConfig.ACMEDomains) > 0 {
+		// ACME listeners are started once with the process, on ports plain HTTP must not take
+		if config.ListenPort == ACMEChallengePort || config.ListenPort == ACMETLSListenPort {
+			if getActiveConfig() == nil {
+				return newConfig, errors.New("ListenPort " + strconv.Itoa(config.ListenPort) + " conflicts with ACME listeners on ports " + strconv.Itoa(ACMEChallengePort) + " and " + strconv.Itoa(ACMETLSListenPort))
+			}
+			log.Println("Warning: ListenPort " + strconv.Itoa(config.ListenPort) + " conflicts with ACME listeners, using default value " + strconv.Itoa(ConfigDefaultListenPort))
+		}
+		if newConfig.TLSCertFile != "" {
+			log.Println("Warning: TLSCertFile and TLSKeyFile are ignored, certificates are obtained via ACME")
+			newConfig.TLSCertFile = ""
+			newConfig.TLSKeyFile = ""
+		}
+	}
+	if config.ACMECacheFolder != "" {
+		newConfig.ACMECacheFolder = config.ACMECacheFolder
+	} else {
+		log.Println("Warning: ACMECacheFolder invalid, using default value " + ConfigDefaultACMECacheFolder)
+	}
+	newConfig.ACMEEmail = config.ACMEEmail
+	if config.ReadTimeoutSec >= 0 {
+		newConfig.ReadTimeoutSec = config.ReadTimeoutSec
+	} else {
+		log.Println("Warning: ReadTimeoutSec out of range, using default value " + strconv.Itoa(ConfigDefaultReadTimeoutSec))
+	}
+	if config.WriteTimeoutSec >= 0 {
+		newConfig.WriteTimeoutSec = config.WriteTimeoutSec
+	} else {
+		log.Println("Warning: WriteTimeoutSec out of range, using default value " + strconv.Itoa(ConfigDefaultWriteTimeoutSec))
+	}
+	if config.IdleTimeoutSec >= 0 {
+		newConfig.IdleTimeoutSec = config.IdleTimeoutSec
+	} else {
+		log.Println("Warning: IdleTimeoutSec out of range, using default value " + strconv.Itoa(ConfigDefaultIdleTimeoutSec))
+	}
 	if config.LogFileName != "" {
 		newConfig.LogFileName = config.LogFileName
 	} else {
 		log.Println("Warning: LogFileName is empty, disabling log file")
 	}
+	if config.LogFormat == LogFormatText || config.LogFormat == LogFormatJSON {
+		newConfig.LogFormat = config.LogFormat
+	} else {
+		log.Println("Warning: LogFormat invalid, using default value " + ConfigDefaultLogFormat)
+	}
+	if _, err := getLogLevel(config.LogLevel); err == nil {
+		newConfig.LogLevel = strings.ToLower(config.LogLevel)
+	} else {
+		log.Println("Warning: LogLevel invalid, using default value " + ConfigDefaultLogLevel)
+	}
+	if config.LogMaxSizeMB >= 0 {
+		newConfig.LogMaxSizeMB = config.LogMaxSizeMB
+	} else {
+		log.Println("Warning: LogMaxSizeMB out of range, using default value " + strconv.Itoa(ConfigDefaultLogMaxSizeMB))
+	}
+	if config.LogMaxBackups >= 0 {
+		newConfig.LogMaxBackups = config.LogMaxBackups
+	} else {
+		log.Println("Warning: LogMaxBackups out of range, using default value " + strconv.Itoa(ConfigDefaultLogMaxBackups))
+	}
+	if config.LogMaxAgeDays >= 0 {
+		newConfig.LogMaxAgeDays = config.LogMaxAgeDays
+	} else {
+		log.Println("Warning: LogMaxAgeDays out of range, using default value " + strconv.Itoa(ConfigDefaultLogMaxAgeDays))
+	}
+	newConfig.AccessLogFileName = config.AccessLogFileName
+	if config.AccessLogFormat == AccessLogFormatCombined || config.AccessLogFormat == AccessLogFormatJSON {
+		newConfig.AccessLogFormat = config.AccessLogFormat
+	} else {
+		log.Println("Warning: AccessLogFormat invalid, using default value " + ConfigDefaultAccessLogFormat)
+	}
+	for _, proxy := range config.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			log.Println("Warning: Proxy \"" + proxy + "\" in TrustedProxies invalid, skipping")
+			continue
+		}
+		newConfig.TrustedProxies = append(newConfig.TrustedProxies, proxy)
+	}
+	newConfig.AdminToken = config.AdminToken
+	if (config.BasicAuthUser == "") == (config.BasicAuthPassword == "") {
+		newConfig.BasicAuthUser = config.BasicAuthUser
+		newConfig.BasicAuthPassword = config.BasicAuthPassword
+	} else {
+		log.Println("Warning: Only one of BasicAuthUser and BasicAuthPassword is set, disabling basic auth")
+	}
+	if config.BasicAuthExemptHealth != nil {
+		newConfig.BasicAuthExemptHealth = config.BasicAuthExemptHealth
+	} else {
+		log.Println("Warning: BasicAuthExemptHealth not set, using default value " + strconv.FormatBool(ConfigDefaultBasicAuthExemptHealth))
+	}
 	if config.Mode == ModeLocal || config.Mode == ModeRemote {
 		newConfig.Mode = config.Mode
 	} else {
 		log.Println("Warning: Mode invalid, using default value " + ModeRemote)
 	}
-	if config.ServeMode == ServeModeLink || config.ServeMode == ServeModeRedirect || config.ServeMode == ServeModeHtml || config.ServeMode == ServeModeFile {
+	if config.ServeMode == ServeModeLink || config.ServeMode == ServeModeRedirect || config.ServeMode == ServeModeHtml || config.ServeMode == ServeModeFile || config.ServeMode == ServeModeJson {
 		newConfig.ServeMode = config.ServeMode
 	} else {
 		log.Println("Warning: ServeMode invalid, using default value " + ServeModeLink)
 	}
+	if baseURL, err := url.Parse(config.BaseURL); config.BaseURL == "" || (err == nil && (baseURL.Scheme == "http" || baseURL.Scheme == "https") && baseURL.Host != "") {
+		// Trailing slashes are dropped so links can be joined with a single slash
+		newConfig.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	} else {
+		log.Println("Warning: BaseURL invalid, using host of each request instead")
+	}
+	for _, host := range config.AllowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			log.Println("Warning: Empty host in AllowedHosts, skipping")
+			continue
+		}
+		newConfig.AllowedHosts = append(newConfig.AllowedHosts, host)
+	}
+	if _, err := os.Stat(config.RobotsFile); config.RobotsFile == "" || err == nil {
+		newConfig.RobotsFile = config.RobotsFile
+	} else {
+		log.Println("Warning: RobotsFile not found, using default robots.txt")
+	}
+	if _, err := os.Stat(config.FaviconFile); config.FaviconFile == "" || err == nil {
+		newConfig.FaviconFile = config.FaviconFile
+	} else {
+		log.Println("Warning: FaviconFile not found, disabling it")
+	}
+	if config.DefaultFavicon != nil {
+		newConfig.DefaultFavicon = config.DefaultFavicon
+	} else {
+		log.Println("Warning: DefaultFavicon not set, using default value " + strconv.FormatBool(ConfigDefaultDefaultFavicon))
+	}
+	if pattern := regexp.MustCompile(`^[a-zA-Z0-9._~/-]*$`); pattern.MatchString(config.PathPrefix) {
+		// Normalize to leading slash and no trailing slash, empty means no prefix
+		newConfig.PathPrefix = strings.TrimRight(config.PathPrefix, "/")
+		if newConfig.PathPrefix != "" && !strings.HasPrefix(newConfig.PathPrefix, "/") {
+			newConfig.PathPrefix = "/" + newConfig.PathPrefix
+		}
+	} else {
+		log.Println("Warning: PathPrefix invalid, using no prefix")
+	}
 	if config.CacheFolder != "" {
 		newConfig.CacheFolder = config.CacheFolder
 	} else {
@@ -103,44 +793,230 @@ func newConfig(config Config) Config {
 	} else {
 		log.Println("Warning: CacheTmpFolder invalid, using default value " + ConfigDefaultCacheTmpFolder)
 	}
+	if config.IndexFileName != "" {
+		newConfig.IndexFileName = config.IndexFileName
+	} else {
+		log.Println("Warning: IndexFileName invalid, using default value " + ConfigDefaultIndexFileName)
+	}
+	if config.IndexBackend == IndexBackendJSON || config.IndexBackend == IndexBackendSQLite {
+		newConfig.IndexBackend = config.IndexBackend
+	} else {
+		log.Println("Warning: IndexBackend invalid, using default value " + ConfigDefaultIndexBackend)
+	}
+	if config.IndexDatabaseFileName != "" {
+		newConfig.IndexDatabaseFileName = config.IndexDatabaseFileName
+	} else {
+		log.Println("Warning: IndexDatabaseFileName invalid, using default value " + ConfigDefaultIndexDatabaseFileName)
+	}
 	if config.UpdateInterval > 0 {
 		newConfig.UpdateInterval = config.UpdateInterval
 	} else {
 		log.Println("Warning: UpdateInterval out of range, using default value " + strconv.FormatInt(ConfigDefaultUpdateInterval, 10))
 	}
+	if config.BackgroundPrefetch != nil {
+		newConfig.BackgroundPrefetch = config.BackgroundPrefetch
+	} else {
+		log.Println("Warning: BackgroundPrefetch not set, using default value " + strconv.FormatBool(ConfigDefaultBackgroundPrefetch))
+	}
+	if config.PrefetchConcurrency > 0 {
+		newConfig.PrefetchConcurrency = config.PrefetchConcurrency
+	} else {
+		log.Println("Warning: PrefetchConcurrency out of range, using default value " + strconv.Itoa(ConfigDefaultPrefetchConcurrency))
+	}
+	if config.MaxConcurrentRetrievals > 0 {
+		newConfig.MaxConcurrentRetrievals = config.MaxConcurrentRetrievals
+	} else {
+		log.Println("Warning: MaxConcurrentRetrievals out of range, using default value " + strconv.Itoa(ConfigDefaultMaxConcurrentRetrievals))
+	}
+	if config.MaxConcurrentRequests >= 0 {
+		newConfig.MaxConcurrentRequests = config.MaxConcurrentRequests
+	} else {
+		log.Println("Warning: MaxConcurrentRequests out of range, using default value " + strconv.Itoa(ConfigDefaultMaxConcurrentRequests))
+	}
+	if config.MaxQueuedRequests >= 0 {
+		newConfig.MaxQueuedRequests = config.MaxQueuedRequests
+	} else {
+		log.Println("Warning: MaxQueuedRequests out of range, using default value " + strconv.Itoa(ConfigDefaultMaxQueuedRequests))
+	}
+	if config.RequestQueueTimeoutSec > 0 {
+		newConfig.RequestQueueTimeoutSec = config.RequestQueueTimeoutSec
+	} else {
+		log.Println("Warning: RequestQueueTimeoutSec out of range, using default value " + strconv.Itoa(ConfigDefaultRequestQueueTimeoutSec))
+	}
+	if config.JanitorIntervalMinutes >= 0 {
+		newConfig.JanitorIntervalMinutes = config.JanitorIntervalMinutes
+	} else {
+		log.Println("Warning: JanitorIntervalMinutes out of range, using default value " + strconv.Itoa(ConfigDefaultJanitorIntervalMinutes))
+	}
 	if config.MaxCacheSize >= 0 {
 		newConfig.MaxCacheSize = config.MaxCacheSize
 	} else {
 		log.Println("Warning: MaxCacheSize out of range, using default value " + strconv.Itoa(ConfigDefaultMaxCacheSize))
 	}
+	if config.MaxCacheSizeMB >= 0 {
+		newConfig.MaxCacheSizeMB = config.MaxCacheSizeMB
+	} else {
+		log.Println("Warning: MaxCacheSizeMB out of range, using default value " + strconv.Itoa(ConfigDefaultMaxCacheSizeMB))
+	}
+	if *newConfig.BackgroundPrefetch && newConfig.Mode == ModeRemote && newConfig.MaxCacheSizeMB == 0 && newConfig.MaxCacheSize == 0 {
+		log.Println("Warning: BackgroundPrefetch is on but needs MaxCacheSize or MaxCacheSizeMB, prefetching is paused until one is set")
+	}
+	if newConfig.MaxCacheSizeMB != 0 && newConfig.MaxCacheSize != 0 {
+		log.Println("Warning: Both MaxCacheSizeMB and MaxCacheSize set, MaxCacheSize is ignored")
+	}
+	newConfig.SwitchToLocalWhenFull = config.SwitchToLocalWhenFull
+	if config.CacheTTLHours >= 0 {
+		newConfig.CacheTTLHours = config.CacheTTLHours
+	} else {
+		log.Println("Warning: CacheTTLHours out of range, using default value " + strconv.Itoa(ConfigDefaultCacheTTLHours))
+	}
+	if config.NearDuplicateThreshold >= 0 && config.NearDuplicateThreshold <= PerceptualHashBits {
+		newConfig.NearDuplicateThreshold = config.NearDuplicateThreshold
+	} else {
+		log.Println("Warning: NearDuplicateThreshold out of range, using default value " + strconv.Itoa(ConfigDefaultNearDuplicateThreshold))
+	}
 	if config.ImageQuality > 0 {
 		newConfig.ImageQuality = config.ImageQuality
 	} else {
 		log.Println("Warning: ImageQuality out of range, using default value " + strconv.Itoa(ConfigDefaultImageQuality))
 	}
+	newConfig.ProgressiveJPEG = config.ProgressiveJPEG
+	if config.MaxImagePixels >= 0 {
+		newConfig.MaxImagePixels = config.MaxImagePixels
+	} else {
+		log.Println("Warning: MaxImagePixels out of range, using default value " + strconv.Itoa(ConfigDefaultMaxImagePixels))
+	}
+	if config.MinWidth >= 0 {
+		newConfig.MinWidth = config.MinWidth
+	} else {
+		log.Println("Warning: MinWidth out of range, using default value " + strconv.Itoa(ConfigDefaultMinWidth))
+	}
+	if config.MinHeight >= 0 {
+		newConfig.MinHeight = config.MinHeight
+	} else {
+		log.Println("Warning: MinHeight out of range, using default value " + strconv.Itoa(ConfigDefaultMinHeight))
+	}
+	if config.MaxDownloadSizeMB >= 0 {
+		newConfig.MaxDownloadSizeMB = config.MaxDownloadSizeMB
+	} else {
+		log.Println("Warning: MaxDownloadSizeMB out of range, using default value " + strconv.Itoa(ConfigDefaultMaxDownloadSizeMB))
+	}
+	if config.RemoteTimeoutSec > 0 {
+		newConfig.RemoteTimeoutSec = config.RemoteTimeoutSec
+	} else {
+		log.Println("Warning: RemoteTimeoutSec out of range, using default value " + strconv.Itoa(ConfigDefaultRemoteTimeoutSec))
+	}
+	if config.MaxRedirects > 0 {
+		newConfig.MaxRedirects = config.MaxRedirects
+	} else {
+		log.Println("Warning: MaxRedirects out of range, using default value " + strconv.Itoa(ConfigDefaultMaxRedirects))
+	}
+	if config.UserAgent != "" {
+		newConfig.UserAgent = config.UserAgent
+	} else {
+		log.Println("Warning: UserAgent empty, using default value " + ConfigDefaultUserAgent)
+	}
+	if err := validateProxy(config.Proxy); err != nil {
+		// Silently connecting directly could expose the server, so refuse to use this config
+		return newConfig, errors.New("Proxy invalid, " + err.Error())
+	}
+	newConfig.Proxy = config.Proxy
+	newConfig.AllowedImageDomains = getDomains(config.AllowedImageDomains, "AllowedImageDomains")
+	newConfig.BlockedImageDomains = getDomains(config.BlockedImageDomains, "BlockedImageDomains")
+	if config.BlockPrivateImageHosts != nil {
+		newConfig.BlockPrivateImageHosts = config.BlockPrivateImageHosts
+	} else {
+		log.Println("Warning: BlockPrivateImageHosts not set, using default value " + strconv.FormatBool(ConfigDefaultBlockPrivateImageHosts))
+	}
+	if config.RemoteFailureThreshold > 0 {
+		newConfig.RemoteFailureThreshold = config.RemoteFailureThreshold
+	} else {
+		log.Println("Warning: RemoteFailureThreshold out of range, using default value " + strconv.Itoa(ConfigDefaultRemoteFailureThreshold))
+	}
+	if config.RemoteCooldownMin > 0 {
+		newConfig.RemoteCooldownMin = config.RemoteCooldownMin
+	} else {
+		log.Println("Warning: RemoteCooldownMin out of range, using default value " + strconv.Itoa(ConfigDefaultRemoteCooldownMin))
+	}
+	newConfig.ValidateRemotesOnStart = config.ValidateRemotesOnStart
+	newConfig.RequireValidRemote = config.RequireValidRemote
+	if config.MaxCount > 0 {
+		newConfig.MaxCount = config.MaxCount
+	} else {
+		log.Println("Warning: MaxCount out of range, using default value " + strconv.Itoa(ConfigDefaultMaxCount))
+	}
+	if config.MaxImagesPerResponse > 0 {
+		newConfig.MaxImagesPerResponse = config.MaxImagesPerResponse
+	} else {
+		log.Println("Warning: MaxImagesPerResponse out of range, using default value " + strconv.Itoa(ConfigDefaultMaxImagesPerResponse))
+	}
+	if config.RecentHistorySize > 0 {
+		newConfig.RecentHistorySize = config.RecentHistorySize
+	} else {
+		log.Println("Warning: RecentHistorySize out of range, using default value " + strconv.Itoa(ConfigDefaultRecentHistorySize))
+	}
+	if config.ClientHistoryIdleMinutes > 0 {
+		newConfig.ClientHistoryIdleMinutes = config.ClientHistoryIdleMinutes
+	} else {
+		log.Println("Warning: ClientHistoryIdleMinutes out of range, using default value " + strconv.Itoa(ConfigDefaultClientHistoryIdleMinutes))
+	}
+	if config.RateLimitPerSecond >= 0 {
+		newConfig.RateLimitPerSecond = config.RateLimitPerSecond
+	} else {
+		log.Println("Warning: RateLimitPerSecond out of range, using default value " + strconv.FormatFloat(ConfigDefaultRateLimitPerSecond, 'f', -1, 64))
+	}
+	if config.RateLimitBurst > 0 {
+		newConfig.RateLimitBurst = config.RateLimitBurst
+	} else {
+		log.Println("Warning: RateLimitBurst out of range, using default value " + strconv.Itoa(ConfigDefaultRateLimitBurst))
+	}
+	if config.StripMetadata != nil {
+		newConfig.StripMetadata = config.StripMetadata
+	} else {
+		log.Println("Warning: StripMetadata not set, using default value " + strconv.FormatBool(ConfigDefaultStripMetadata))
+	}
+	if config.AllowedOrigins != nil {
+		newConfig.AllowedOrigins = config.AllowedOrigins
+	} else {
+		log.Println("Warning: AllowedOrigins not set, using default value [" + ConfigDefaultAllowedOrigin + "]")
+	}
+	if config.CacheControlMaxAge >= 0 {
+		newConfig.CacheControlMaxAge = config.CacheControlMaxAge
+	} else {
+		log.Println("Warning: CacheControlMaxAge out of range, using default value " + strconv.Itoa(ConfigDefaultCacheControlMaxAge))
+	}
 	if config.Remotes != nil {
-		newConfig.Remotes = config.Remotes
+		// Empty list stays empty instead of falling back to default remotes on next start
+		newConfig.Remotes = []Remote{}
+		for _, remote := range config.Remotes {
+			if remote.URL == "" {
+				log.Println("Warning: Remote without URL, skipping")
+				continue
+			}
+			remote, err := normalizeRemote(remote, newConfig.CacheTmpFolder)
+			if err != nil {
+				return newConfig, err
+			}
+			newConfig.Remotes = append(newConfig.Remotes, remote)
+		}
 	} else {
 		log.Println("Warning: Remotes invalid, using default value [" + ConfigDefaultRemote1 + ", " + ConfigDefaultRemote2 + "]")
 	}
 
 	// Finished creating config
-	return newConfig
+	return newConfig, nil
 }
 
 // Function for reading config from file
-func readConfig() Config {
+func readConfig() (Config, error) {
 	// Read config file
+	var config Config
 	file, err := ioutil.ReadFile(DefaultConfigFileName)
 	if err != nil {
-		log.Fatalln("Error:", err)
+		return config, err
 	}
-	var config Config
 	err = json.Unmarshal(file, &config)
-	if err != nil {
-		log.Fatalln("Error:", err)
-	}
-	return config
+	return config, err
 }
 
 // Function for writing config to file
@@ -149,37 +1025,121 @@ func writeConfig(config Config) {
 	file, _ := json.MarshalIndent(config, "", "\t")
 	err := ioutil.WriteFile(DefaultConfigFileName, file, 0644)
 	if err != nil {
-		log.Println("Error:", err)
+		slog.Error("Failed to write config file", "file", DefaultConfigFileName, "error", err)
 	}
 }
 
-// Function for general config reading/writing/creating
-func getConfig() Config {
+// Function for general config reading/writing/creating, config file is left alone if it is invalid
+func getConfig() (Config, error) {
 	// Reacd/Write/Create config file
 	var config Config
 	if _, err := os.Stat(DefaultConfigFileName); err == nil {
 		log.Println("Config file found, reading...")
-		config = newConfig(readConfig())
+		if config, err = readConfig(); err != nil {
+			return config, err
+		}
 	} else if errors.Is(err, os.ErrNotExist) {
 		// No config file, create one
 		log.Println("No config file found, creating one...")
-		config = newConfig(config)
 	} else {
-		log.Fatalln("Error:", err)
+		return config, err
+	}
+	config, err := newConfig(config)
+	if err != nil {
+		return config, err
 	}
 	writeConfig(config)
-	return config
+	return config, nil
 }
 
 // Function for reloading config file
 func reloadConfig(w http.ResponseWriter, r *http.Request) {
-	config = getConfig()
-	log.Println("Reloaded config: \n", getConfigString(config))
+	// Reloading rewrites config file, so only admins can trigger it
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	// Replace config as a whole, so requests in progress keep seeing the old one consistently
+	configUpdateLock.Lock()
+	previous := getActiveConfig()
+	config, err := getConfig()
+	if err != nil {
+		configUpdateLock.Unlock()
+		slog.Error("Config not reloaded, keeping config in use", "error", err)
+		http.Error(w, "Config not reloaded: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	activeConfig.Store(&config)
+	configUpdateLock.Unlock()
+	// Image index is opened once at startup
+	if config.IndexBackend != previous.IndexBackend || config.IndexFileName != previous.IndexFileName || config.IndexDatabaseFileName != previous.IndexDatabaseFileName {
+		log.Println("Warning: Changes of IndexBackend, IndexFileName and IndexDatabaseFileName take effect after restart")
+	}
+	if config.MaxConcurrentRequests != previous.MaxConcurrentRequests {
+		setRequestSlots(config.MaxConcurrentRequests)
+	}
+	// Purge relies on holding every retrieval slot, so they are sized once at startup
+	if config.MaxConcurrentRetrievals != previous.MaxConcurrentRetrievals {
+		log.Println("Warning: Changes of MaxConcurrentRetrievals take effect after restart")
+	}
+	initHTTPClients()
+	setLogLevel(config)
+	// CacheFolder may have changed
+	invalidateCachedFiles()
+	logConfig("Reloaded config", config)
+	if config.ValidateRemotesOnStart {
+		// Probing may take up to RemoteTimeoutSec, don't hold the response
+		go validateRemotes()
+	}
 	fmt.Fprintf(w, "Config reloaded")
 }
 
-// Function for converting config to pretty string
+// Function for getting copy of remote with values of headers not in PublicHeaders redacted
+func getRedactedRemote(remote Remote) Remote {
+	if remote.Headers == nil {
+		return remote
+	}
+	headers := map[string]string{}
+	for name, value := range remote.Headers {
+		if !containsString(PublicHeaders, http.CanonicalHeaderKey(name)) {
+			value = "REDACTED"
+		}
+		headers[name] = value
+	}
+	remote.Headers = headers
+	return remote
+}
+
+// Function for getting config currently in use, the returned config must not be modified
+func getActiveConfig() *Config {
+	return activeConfig.Load()
+}
+
+// Function for changing a copy of config in use with update, then replacing config with it and writing it to file unless update fails
+func updateConfig(update func(config *Config) error) error {
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+	config := *getActiveConfig()
+	if err := update(&config); err != nil {
+		return err
+	}
+	activeConfig.Store(&config)
+	writeConfig(config)
+	return nil
+}
+
+// Function for converting config to pretty string, redacting header values of remotes that may contain secrets
 func getConfigString(config Config) string {
+	remotes := make([]Remote, len(config.Remotes))
+	for i, remote := range config.Remotes {
+		remotes[i] = getRedactedRemote(remote)
+	}
+	config.Remotes = remotes
+	if config.AdminToken != "" {
+		config.AdminToken = "REDACTED"
+	}
+	if config.BasicAuthPassword != "" {
+		config.BasicAuthPassword = "REDACTED"
+	}
 	configString, err := json.MarshalIndent(config, "", "\t")
 	if err != nil {
 		return fmt.Sprintf("%+v\n", config)
@@ -188,375 +1148,6197 @@ func getConfigString(config Config) string {
 	}
 }
 
-// Function for getting file extension from MIME type
-func getExtension(contentType string) string {
-	if contentType == "image/jpeg" {
-		return "jpg"
-	}
-	if contentType == "image/png" {
-		return "png"
+// Function for normalizing domains of domain list in config, invalid entries are skipped
+func getDomains(domains []string, name string) []string {
+	var normalized []string
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" || strings.ContainsAny(domain, "/:@ ") {
+			log.Println("Warning: Domain \"" + domain + "\" in " + name + " invalid, skipping")
+			continue
+		}
+		normalized = append(normalized, domain)
 	}
-	return ""
+	return normalized
 }
 
-// Function for extracting imgURL from a json response
-func getImgURL(response string) string {
-	// Use regex to extract image URL from http response
-	response = strings.Replace(response, `\/`, "/", -1)
-	pattern := regexp.MustCompile(`https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()@:%_\+.~#?&//=]*)(jpg|jpeg|png)`)
-	return pattern.FindString(response)
-}
-
-// Function for extracting image extension from a filename/URL
-func getImgExtension(filename string) string {
-	pattern := regexp.MustCompile(`.+\.(?i)(jpg|jpeg|png)$`)
-	match := pattern.FindStringSubmatch(filename)
-	if len(match) >= 2 {
-		return strings.ToLower(match[1])
+// Function for checking whether host is domain or one of its subdomains, IP addresses only match exactly
+func matchesDomain(host string, domain string) bool {
+	if net.ParseIP(host) != nil {
+		return host == domain
 	}
-	return ""
+	return host == domain || strings.HasSuffix(host, "."+domain)
 }
 
-// Function for downloading file from URL to given local filename
-func downloadFile(filename string, URL string) error {
+// Function for checking whether IP address is loopback, private, link-local or unspecified
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
 
-	// Create the file
-	out, err := os.Create(filename)
-	if err != nil {
-		return err
+// Function for refusing connections of image downloads to private addresses if BlockPrivateImageHosts is set, checked against the address actually dialed so DNS rebinding and redirects can't get around it
+func checkImgDial(network string, address string, _ syscall.RawConn) error {
+	config := getActiveConfig()
+	if !*config.BlockPrivateImageHosts {
+		return nil
 	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := http.Get(URL)
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errors.New("refused connection to private address " + host)
 	}
-
 	return nil
 }
 
-// Function to compress image to given quality in config
-func compressImage(data []byte) ([]byte, error) {
-	imgSrc, _, err := image.Decode(bytes.NewReader(data))
-	if err != nil {
-		return data, err
-	}
-	newImg := image.NewRGBA(imgSrc.Bounds())
-	draw.Draw(newImg, newImg.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
-	draw.Draw(newImg, newImg.Bounds(), imgSrc, imgSrc.Bounds().Min, draw.Over)
-	buf := bytes.Buffer{}
-	err = jpeg.Encode(&buf, newImg, &jpeg.Options{Quality: config.ImageQuality})
+// Function for getting address a proxy URL is dialed at, with default port of its scheme if it has none
+func getProxyAddress(proxy string) string {
+	proxyURL, err := url.Parse(proxy)
 	if err != nil {
-		return data, err
+		return ""
 	}
-	if buf.Len() > len(data) {
-		return data, nil
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
 	}
-	return buf.Bytes(), nil
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxyURL.Scheme]
+	return net.JoinHostPort(proxyURL.Hostname(), port)
 }
 
-// Function for detecting if a file is a valid and supported image
-func isImage(filename string) bool {
-	// Frist check if file extension is supported
-	if getImgExtension(filename) == "" {
-		return false
-	}
-	// Then check content type by opening and read it into buffer
-	filename = config.CacheFolder + string(os.PathSeparator) + filename
-	imageFile, err := os.Open(filename)
+// Function for checking image URL against AllowedImageDomains, BlockedImageDomains and BlockPrivateImageHosts in config, downloads are checked again by checkImgDial when connecting
+func checkImgURL(imgURL string) error {
+	config := getActiveConfig()
+	parsedURL, err := url.Parse(imgURL)
 	if err != nil {
-		log.Println("Error:", err)
-		return false
+		return err
 	}
-	defer imageFile.Close()
-	// Only take the first 512 bytes of the file to check the content type
-	buff := make([]byte, 512)
-	if _, err = imageFile.Read(buff); err != nil {
-		// File is not an image, return false
-		return false
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return errors.New("scheme " + parsedURL.Scheme + " not allowed")
 	}
-
-	return true
+	// Hostname strips port and brackets of IPv6 addresses
+	host := strings.TrimSuffix(strings.ToLower(parsedURL.Hostname()), ".")
+	if host == "" {
+		return errors.New("no host")
+	}
+	for _, domain := range config.BlockedImageDomains {
+		if matchesDomain(host, domain) {
+			return errors.New("host " + host + " is blocked")
+		}
+	}
+	if len(config.AllowedImageDomains) > 0 {
+		allowed := false
+		for _, domain := range config.AllowedImageDomains {
+			if matchesDomain(host, domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("host " + host + " is not allowed")
+		}
+	}
+	if *config.BlockPrivateImageHosts {
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			ips, err = net.LookupIP(host)
+			if err != nil {
+				return err
+			}
+		}
+		for _, ip := range ips {
+			if isPrivateIP(ip) {
+				return errors.New("host " + host + " resolves to private address " + ip.String())
+			}
+		}
+	}
+	return nil
+}
+
+// Function for validating remote and replacing its invalid fields with defaults, returns error if remote is unusable
+func normalizeRemote(remote Remote, tmpFolder string) (Remote, error) {
+	if remote.URL == "" {
+		return remote, errors.New("Remote without URL")
+	}
+	if remote.Category != "" && !isValidCategory(remote.Category, tmpFolder) {
+		log.Println("Warning: Category of remote " + remote.URL + " invalid, using no category")
+		remote.Category = ""
+	}
+	if err := validateProxy(remote.Proxy); err != nil {
+		return remote, errors.New("Proxy of remote " + remote.URL + " invalid, " + err.Error())
+	}
+	remote.Method = strings.ToUpper(remote.Method)
+	if remote.Method != "" && remote.Method != "GET" && remote.Method != "POST" {
+		log.Println("Warning: Method of remote " + remote.URL + " invalid, using GET")
+		remote.Method = ""
+	}
+	if remote.Weight < 0 || math.IsNaN(remote.Weight) || math.IsInf(remote.Weight, 0) {
+		log.Println("Warning: Weight of remote " + remote.URL + " invalid, using default value " + strconv.FormatFloat(ConfigDefaultRemoteWeight, 'f', -1, 64))
+		remote.Weight = ConfigDefaultRemoteWeight
+	}
+	if remote.UpdateInterval < 0 {
+		log.Println("Warning: UpdateInterval of remote " + remote.URL + " out of range, using UpdateInterval in config")
+		remote.UpdateInterval = 0
+	}
+	return remote, nil
+}
+
+// Function for validating a proxy URL, empty means no proxy
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") || proxyURL.Host == "" {
+		return errors.New("must be a http://, https:// or socks5:// URL with host")
+	}
+	return nil
+}
+
+// Function for parsing a remote from either a plain URL string or an object with URL, Category and Weight
+func (remote *Remote) UnmarshalJSON(data []byte) error {
+	var remoteURL string
+	if err := json.Unmarshal(data, &remoteURL); err == nil {
+		*remote = Remote{URL: remoteURL, Weight: ConfigDefaultRemoteWeight}
+		return nil
+	}
+	// Fields missing from object keep their defaults
+	type plainRemote Remote
+	*remote = Remote{Weight: ConfigDefaultRemoteWeight}
+	return json.Unmarshal(data, (*plainRemote)(remote))
+}
+
+// Function for validating a category name, which is also used as subfolder name of cache folder
+func isValidCategory(category string, tmpFolder string) bool {
+	pattern := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	return pattern.MatchString(category) && category != tmpFolder
+}
+
+// Function for getting sorted distinct categories of all remotes
+func getCategories() []string {
+	var categories []string
+	for _, remote := range getRemotes() {
+		if remote.Category != "" && !containsString(categories, remote.Category) {
+			categories = append(categories, remote.Category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Function for checking if a string slice contains a value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for getting file extension from MIME type
+func getExtension(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "jpg"
+	}
+	if contentType == "image/png" {
+		return "png"
+	}
+	return ""
+}
+
+// Function for checking whether data is an image of a supported format by sniffing its first bytes, returns its extension
+func sniffImage(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	extension := getExtension(contentType)
+	if extension == "" {
+		return "", errors.New("detected content type " + contentType)
+	}
+	return extension, nil
+}
+
+// Function for extracting distinct image URLs from a json response, in order of appearance
+func getImgURLs(response string) []string {
+	// Use regex to extract image URLs from http response
+	response = strings.Replace(response, `\/`, "/", -1)
+	pattern := regexp.MustCompile(`https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()@:%_\+.~#?&//=]*)(jpg|jpeg|png)`)
+	var imgURLs []string
+	for _, imgURL := range pattern.FindAllString(response, -1) {
+		if !containsString(imgURLs, imgURL) {
+			imgURLs = append(imgURLs, imgURL)
+		}
+	}
+	return imgURLs
+}
+
+// Function for extracting a relative or protocol-relative image URL in quotes from a json response
+func getRelativeImgURL(response string) string {
+	response = strings.Replace(response, `\/`, "/", -1)
+	pattern := regexp.MustCompile(`"((?://[^"\s/]+)?[^"\s:]+\.(?i)(jpg|jpeg|png)(\?[^"\s]*)?)"`)
+	match := pattern.FindStringSubmatch(response)
+	if len(match) >= 2 {
+		return match[1]
+	}
+	return ""
+}
+
+// Function for resolving an image URL against URL of the remote it was returned by
+func resolveImgURL(remoteURL string, imgURL string) string {
+	base, err := url.Parse(remoteURL)
+	if err != nil {
+		return imgURL
+	}
+	reference, err := url.Parse(imgURL)
+	if err != nil {
+		return imgURL
+	}
+	return base.ResolveReference(reference).String()
+}
+
+// Function for extracting a base64 image data URI from a json response
+func getDataURI(response string) string {
+	response = strings.Replace(response, `\/`, "/", -1)
+	pattern := regexp.MustCompile(`data:image/[a-zA-Z0-9.+-]+;base64,[A-Za-z0-9+/=]+`)
+	return pattern.FindString(response)
+}
+
+// Function for decoding a base64 data URI or plain base64 string, returns image data and extension from MIME type of data URI
+func decodeImageData(value string) ([]byte, string, error) {
+	extension := ""
+	if strings.HasPrefix(value, "data:") {
+		comma := strings.Index(value, ",")
+		if comma < 0 || !strings.HasSuffix(value[:comma], ";base64") {
+			return nil, "", errors.New("Data URI is not base64 encoded")
+		}
+		extension = getExtension(strings.TrimSuffix(strings.TrimPrefix(value[:comma], "data:"), ";base64"))
+		value = value[comma+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, extension, nil
+}
+
+// Function for extracting a string or array of strings from a json response with a selector like "data[0].urls.original"
+func getJSONStrings(response []byte, selector string) ([]string, error) {
+	var value interface{}
+	if err := json.Unmarshal(response, &value); err != nil {
+		return nil, err
+	}
+	pattern := regexp.MustCompile(`^([^.\[\]]*)((?:\[\d+\])*)$`)
+	for _, part := range strings.Split(selector, ".") {
+		match := pattern.FindStringSubmatch(part)
+		if match == nil {
+			return nil, errors.New("Invalid selector part " + part)
+		}
+		// Object key first, then any number of array indexes
+		if match[1] != "" {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("Selector part " + match[1] + " expects an object")
+			}
+			if value, ok = object[match[1]]; !ok {
+				return nil, errors.New("Key " + match[1] + " not found")
+			}
+		}
+		for _, index := range regexp.MustCompile(`\d+`).FindAllString(match[2], -1) {
+			array, ok := value.([]interface{})
+			i, _ := strconv.Atoi(index)
+			if !ok || i >= len(array) {
+				return nil, errors.New("Index " + index + " not found")
+			}
+			value = array[i]
+		}
+	}
+	// Selected value is either a string or an array of them
+	if result, ok := value.(string); ok {
+		return []string{result}, nil
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("Selected value is not a string or array")
+	}
+	var results []string
+	for _, element := range array {
+		if result, ok := element.(string); ok {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// Function for extracting image extension from a filename/URL
+func getImgExtension(filename string) string {
+	pattern := regexp.MustCompile(`.+\.(?i)(jpg|jpeg|png)$`)
+	match := pattern.FindStringSubmatch(filename)
+	if len(match) >= 2 {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+// Function for creating HTTP clients for requests to remotes, with timeout from config and reused connections
+func initHTTPClients() {
+	config := getActiveConfig()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = MaxIdleConnsPerRemote
+	// Proxy of remote attached to request takes precedence over Proxy in config
+	transport.Proxy = func(request *http.Request) (*url.URL, error) {
+		proxy, _ := request.Context().Value(proxyContextKey{}).(string)
+		if proxy == "" {
+			proxy = config.Proxy
+		}
+		if proxy == "" {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+	// Downloads connect to private addresses only through proxies, which admins may run on private addresses
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	imageDialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkImgDial}
+	downloadTransport := transport.Clone()
+	downloadTransport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		proxy, _ := ctx.Value(proxyContextKey{}).(string)
+		if proxy == "" {
+			proxy = config.Proxy
+		}
+		if proxy != "" && address == getProxyAddress(proxy) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return imageDialer.DialContext(ctx, network, address)
+	}
+	// Downloads follow at most MaxRedirects redirects
+	httpClient.Store(&http.Client{
+		Timeout:   time.Duration(config.RemoteTimeoutSec) * time.Second,
+		Transport: downloadTransport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > config.MaxRedirects {
+				return errors.New("Stopped after " + strconv.Itoa(config.MaxRedirects) + " redirects")
+			}
+			// Redirects must not lead to hosts that image URLs could not point to
+			if err := checkImgURL(request.URL.String()); err != nil {
+				return errors.New("Refused redirect to URL " + request.URL.String() + ", " + err.Error())
+			}
+			return nil
+		},
+	})
+	// API requests return redirects as they are, so Location can be used as image URL
+	apiClient.Store(&http.Client{
+		Timeout:   time.Duration(config.RemoteTimeoutSec) * time.Second,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	})
+}
+
+// Function for sending request for remote with given client, method (GET if empty) and json body, using headers and proxy of remote
+func requestRemote(client *http.Client, method string, URL string, body []byte, remote Remote) (*http.Response, error) {
+	config := getActiveConfig()
+	if method == "" {
+		method = "GET"
+	}
+	request, err := http.NewRequest(method, URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	// Headers of remote take precedence over UserAgent in config
+	request.Header.Set("User-Agent", config.UserAgent)
+	for name, value := range remote.Headers {
+		request.Header.Set(name, value)
+	}
+	if remote.Proxy != "" {
+		request = request.WithContext(context.WithValue(request.Context(), proxyContextKey{}, remote.Proxy))
+	}
+	return client.Do(request)
+}
+
+// Function for downloading file from URL to given local filename, using headers and proxy of remote
+func downloadFile(ctx context.Context, filename string, URL string, remote Remote) error {
+	logger := getLogger(ctx)
+	config := getActiveConfig()
+
+	// Get the data
+	resp, err := requestRemote(httpClient.Load(), "GET", URL, nil, remote)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Request.URL.String() != URL {
+		logger.Debug("Redirected to URL", "url", URL, "location", resp.Request.URL.String())
+	}
+
+	// Only successful responses that may contain an image are written to disk
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Invalid response status code " + strconv.Itoa(resp.StatusCode) + " from " + URL)
+	}
+	if !isAcceptableImageContentType(resp.Header.Get("Content-Type")) {
+		return errors.New("Invalid content type " + resp.Header.Get("Content-Type") + " from " + URL)
+	}
+
+	// Check declared size against MaxDownloadSizeMB
+	maxSize := int64(config.MaxDownloadSizeMB) * 1024 * 1024
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return errors.New("Content-Length " + strconv.FormatInt(resp.ContentLength, 10) + " exceeds MaxDownloadSizeMB, aborted download from " + URL)
+	}
+
+	// Create the file
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Writer the body to file, reading at most one byte more than the limit to detect oversized bodies
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	written, err := io.Copy(out, body)
+	if err == nil && maxSize > 0 && written > maxSize {
+		err = errors.New("Body exceeds MaxDownloadSizeMB, aborted download from " + URL)
+	}
+	if err != nil {
+		// Never leave a partial file behind
+		out.Close()
+		os.Remove(filename)
+		return err
+	}
+
+	return nil
+}
+
+// Function for checking whether content type of a download may be an image, generic binary types are accepted since content is checked later
+func isAcceptableImageContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Missing or malformed content type, content decides
+		return true
+	}
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
+
+// Function for reading EXIF orientation tag from JPEG data, 1 means no transformation needed
+func getExifOrientation(data []byte) (int, error) {
+	// Only JPEG files carry EXIF in APP1 segment
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1, nil
+	}
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xff {
+			return 1, errors.New("invalid JPEG marker while reading EXIF")
+		}
+		marker := data[offset+1]
+		// Image data starts at SOS, no EXIF found
+		if marker == 0xda || marker == 0xd9 {
+			return 1, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return 1, errors.New("invalid JPEG segment length while reading EXIF")
+		}
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xe1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return parseExifOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1, nil
+}
+
+// Function for finding orientation tag in IFD0 of EXIF TIFF data
+func parseExifOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 1, errors.New("EXIF data too short")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1, errors.New("invalid EXIF byte order")
+	}
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
+		return 1, errors.New("invalid EXIF IFD offset")
+	}
+	entries := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1, errors.New("EXIF IFD truncated")
+		}
+		// Orientation tag is 0x0112 of type SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1, errors.New("invalid EXIF orientation " + strconv.Itoa(orientation))
+			}
+			return orientation, nil
+		}
+	}
+	return 1, nil
+}
+
+// Function for getting a reader of premultiplied 8-bit RGBA pixel values, avoiding a full copy of the image
+func getPixelReader(img image.Image) func(x int, y int) (uint8, uint8, uint8, uint8) {
+	switch src := img.(type) {
+	case *image.RGBA:
+		return func(x int, y int) (uint8, uint8, uint8, uint8) {
+			offset := src.PixOffset(x, y)
+			return src.Pix[offset], src.Pix[offset+1], src.Pix[offset+2], src.Pix[offset+3]
+		}
+	case *image.YCbCr:
+		return func(x int, y int) (uint8, uint8, uint8, uint8) {
+			r, g, b := color.YCbCrToRGB(src.Y[src.YOffset(x, y)], src.Cb[src.COffset(x, y)], src.Cr[src.COffset(x, y)])
+			return r, g, b, 0xff
+		}
+	case *image.Gray:
+		return func(x int, y int) (uint8, uint8, uint8, uint8) {
+			v := src.Pix[src.PixOffset(x, y)]
+			return v, v, v, 0xff
+		}
+	default:
+		return func(x int, y int) (uint8, uint8, uint8, uint8) {
+			r, g, b, a := img.At(x, y).RGBA()
+			return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)
+		}
+	}
+}
+
+// Function for rotating/flipping image pixels according to EXIF orientation
+func applyOrientation(imgSrc image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return imgSrc
+	}
+	bounds := imgSrc.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	pixel := getPixelReader(imgSrc)
+
+	// Orientations 5-8 swap width and height
+	dstWidth, dstHeight := srcWidth, srcHeight
+	if orientation >= 5 {
+		dstWidth, dstHeight = srcHeight, srcWidth
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			// Find source pixel for this destination pixel
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = srcWidth-1-x, y
+			case 3:
+				sx, sy = srcWidth-1-x, srcHeight-1-y
+			case 4:
+				sx, sy = x, srcHeight-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, srcHeight-1-x
+			case 7:
+				sx, sy = srcWidth-1-y, srcHeight-1-x
+			case 8:
+				sx, sy = srcWidth-1-y, x
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset], dst.Pix[offset+1], dst.Pix[offset+2], dst.Pix[offset+3] = pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+		}
+	}
+	return dst
+}
+
+// Function for removing EXIF/XMP/ICC and other metadata from JPEG or PNG data
+func stripMetadata(data []byte) ([]byte, error) {
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8 {
+		return stripJPEGMetadata(data)
+	}
+	if len(data) >= 8 && string(data[:8]) == "\x89PNG\r\n\x1a\n" {
+		return stripPNGMetadata(data)
+	}
+	return data, errors.New("unsupported image format for stripping metadata")
+}
+
+// Function for removing APPn (except JFIF and Adobe) and COM segments from JPEG data
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	stripped := []byte{0xff, 0xd8}
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xff {
+			return data, errors.New("invalid JPEG marker while stripping metadata")
+		}
+		marker := data[offset+1]
+		// Skip fill bytes
+		if marker == 0xff {
+			offset++
+			continue
+		}
+		// Everything from SOS on is image data, copy as is
+		if marker == 0xda {
+			return append(stripped, data[offset:]...), nil
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return data, errors.New("invalid JPEG segment length while stripping metadata")
+		}
+		if !(marker >= 0xe1 && marker <= 0xef && marker != 0xee) && marker != 0xfe {
+			stripped = append(stripped, data[offset:offset+2+length]...)
+		}
+		offset += 2 + length
+	}
+	return data, errors.New("JPEG image data not found while stripping metadata")
+}
+
+// Function for removing text, EXIF, ICC profile and timestamp chunks from PNG data
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	stripped := append([]byte{}, data[:8]...)
+	offset := 8
+	for offset+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if length < 0 || offset+12+length > len(data) {
+			return data, errors.New("invalid PNG chunk length while stripping metadata")
+		}
+		chunkType := string(data[offset+4 : offset+8])
+		if chunkType != "tEXt" && chunkType != "zTXt" && chunkType != "iTXt" && chunkType != "eXIf" && chunkType != "iCCP" && chunkType != "tIME" {
+			stripped = append(stripped, data[offset:offset+12+length]...)
+		}
+		offset += 12 + length
+		if chunkType == "IEND" {
+			return stripped, nil
+		}
+	}
+	return data, errors.New("PNG end chunk not found while stripping metadata")
+}
+
+// Function to compress image to given quality, 0 means quality in config
+func compressImage(ctx context.Context, data []byte, quality int) ([]byte, error) {
+	logger := getLogger(ctx)
+	config := getActiveConfig()
+	if quality == 0 {
+		quality = config.ImageQuality
+	}
+	// Read dimensions first to know how much memory decoding the image takes
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, err
+	}
+	pixels := imgConfig.Width * imgConfig.Height
+	if pixels > LargeImagePixels {
+		// Decode large images one at a time, so concurrent retrievals do not multiply peak memory
+		largeImageSlot <- struct{}{}
+		defer func() { <-largeImageSlot }()
+	}
+	imgSrc, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, err
+	}
+	// Downscale images above MaxImagePixels before doing anything else, so no further full size copy is made
+	downscaled := false
+	if config.MaxImagePixels > 0 && pixels > config.MaxImagePixels {
+		scale := math.Sqrt(float64(config.MaxImagePixels) / float64(pixels))
+		imgSrc = resizeImage(imgSrc, int(float64(imgConfig.Width)*scale), int(float64(imgConfig.Height)*scale))
+		downscaled = true
+		logger.Info("Downscaled large image", "width", imgConfig.Width, "height", imgConfig.Height, "new_width", imgSrc.Bounds().Dx(), "new_height", imgSrc.Bounds().Dy())
+	}
+	// Rotate/flip pixels according to EXIF orientation, since re-encoding drops the tag
+	orientation, err := getExifOrientation(data)
+	if err != nil {
+		logger.Warn("Failed to read EXIF orientation", "error", err)
+	}
+	imgSrc = applyOrientation(imgSrc, orientation)
+	// Only draw onto white background if the image may contain transparency
+	newImg := imgSrc
+	if opaqueImg, ok := imgSrc.(interface{ Opaque() bool }); !ok || !opaqueImg.Opaque() {
+		flatImg := image.NewRGBA(imgSrc.Bounds())
+		draw.Draw(flatImg, flatImg.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+		draw.Draw(flatImg, flatImg.Bounds(), imgSrc, imgSrc.Bounds().Min, draw.Over)
+		newImg = flatImg
+	}
+	buf := bytes.Buffer{}
+	err = encodeJPEG(&buf, newImg, quality)
+	if err != nil {
+		return data, err
+	}
+	// Keep original if it is smaller, unless its pixels had to be reoriented or downscaled
+	if buf.Len() > len(data) && orientation == 1 && !downscaled {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// Standard JPEG quantization tables for luminance and chrominance, in zig-zag order
+var jpegUnscaledQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// Mapping from zig-zag order to natural order of the coefficients in a 8x8 block
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Standard JPEG Huffman tables: luminance DC, luminance AC, chrominance DC and chrominance AC
+var jpegHuffmanSpecs = [4]struct {
+	class byte
+	id    byte
+	count [16]byte
+	value []byte
+}{
+	{0, 0, [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	{1, 0, [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125}, []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}},
+	{0, 1, [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	{1, 1, [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119}, []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}},
+}
+
+// Writer for Huffman coded JPEG scan data, bits are kept left-aligned in a 32-bit buffer
+type jpegBitWriter struct {
+	w       *bufio.Writer
+	bits    uint32
+	nBits   uint32
+	huffman [4][256]uint32
+}
+
+// Function for writing given number of bits with 0xff byte stuffing
+func (bw *jpegBitWriter) emit(bits uint32, nBits uint32) {
+	nBits += bw.nBits
+	bits <<= 32 - nBits
+	bits |= bw.bits
+	for nBits >= 8 {
+		b := uint8(bits >> 24)
+		bw.w.WriteByte(b)
+		if b == 0xff {
+			bw.w.WriteByte(0x00)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	bw.bits, bw.nBits = bits, nBits
+}
+
+// Function for writing the Huffman code of a value from given table
+func (bw *jpegBitWriter) emitHuff(table int, value int) {
+	code := bw.huffman[table][value]
+	bw.emit(code&(1<<24-1), code>>24)
+}
+
+// Function for writing a run length and coefficient value pair
+func (bw *jpegBitWriter) emitHuffRLE(table int, runLength int, value int) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	nBits := uint32(mathbits.Len32(uint32(a)))
+	bw.emitHuff(table, runLength<<4|int(nBits))
+	if nBits > 0 {
+		bw.emit(uint32(b)&(1<<nBits-1), nBits)
+	}
+}
+
+// Function for padding the last byte of a scan with 1 bits
+func (bw *jpegBitWriter) flush() {
+	bw.emit(0x7f, 7)
+	bw.bits, bw.nBits = 0, 0
+}
+
+// Function for writing a JPEG marker segment
+func writeJPEGSegment(w *bufio.Writer, marker byte, data []byte) {
+	w.Write([]byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+	w.Write(data)
+}
+
+// Function for encoding image as progressive JPEG (4:2:0, spectral selection only)
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width >= 1<<16 || height >= 1<<16 {
+		return errors.New("jpeg: image size out of range")
+	}
+	pixel := getPixelReader(img)
+
+	// Scale quantization tables according to quality
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]int
+	for i := range quant {
+		for j := range quant[i] {
+			x := (jpegUnscaledQuant[i][j]*scale + 50) / 100
+			if x < 1 {
+				x = 1
+			} else if x > 255 {
+				x = 255
+			}
+			quant[i][j] = x
+		}
+	}
+
+	// Precompute DCT cosine table
+	var cosTable [8][8]float64
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			cosTable[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+		}
+	}
+
+	// Transform and quantize given samples of a 8x8 block, coefficients are stored in zig-zag order
+	var tmp [64]float64
+	transform := func(samples *[64]float64, table int, coefs []int16) {
+		// Separable forward DCT, rows then columns
+		for y := 0; y < 8; y++ {
+			for u := 0; u < 8; u++ {
+				sum := 0.0
+				for x := 0; x < 8; x++ {
+					sum += samples[y*8+x] * cosTable[x][u]
+				}
+				tmp[y*8+u] = sum
+			}
+		}
+		for k := 0; k < 64; k++ {
+			u, v := jpegZigzag[k]%8, jpegZigzag[k]/8
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += tmp[y*8+u] * cosTable[y][v]
+			}
+			sum /= 4
+			if u == 0 {
+				sum /= math.Sqrt2
+			}
+			if v == 0 {
+				sum /= math.Sqrt2
+			}
+			coefs[k] = int16(math.Round(sum / float64(quant[table][k])))
+		}
+	}
+
+	// Luminance is sampled at full resolution and chrominance at half (4:2:0), so one MCU covers 16x16 pixels
+	mcusX, mcusY := (width+15)/16, (height+15)/16
+	blocksX := [3]int{mcusX * 2, mcusX, mcusX}
+	var coefs [3][]int16
+	coefs[0] = make([]int16, mcusX*mcusY*4*64)
+	coefs[1] = make([]int16, mcusX*mcusY*64)
+	coefs[2] = make([]int16, mcusX*mcusY*64)
+	var samples [3][64]float64
+	for by := 0; by < mcusY*2; by++ {
+		for bx := 0; bx < mcusX*2; bx++ {
+			// Convert RGB to level shifted luminance, replicating edge pixels for partial blocks
+			for y := 0; y < 8; y++ {
+				sy := by*8 + y
+				if sy >= height {
+					sy = height - 1
+				}
+				for x := 0; x < 8; x++ {
+					sx := bx*8 + x
+					if sx >= width {
+						sx = width - 1
+					}
+					r, g, b, _ := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+					samples[0][y*8+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b) - 128
+				}
+			}
+			block := by*blocksX[0] + bx
+			transform(&samples[0], 0, coefs[0][block*64:block*64+64])
+		}
+	}
+	for by := 0; by < mcusY; by++ {
+		for bx := 0; bx < mcusX; bx++ {
+			// Convert RGB to chrominance, averaging each 2x2 pixel area
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					var cb, cr float64
+					for d := 0; d < 4; d++ {
+						sx, sy := bx*16+x*2+d%2, by*16+y*2+d/2
+						if sx >= width {
+							sx = width - 1
+						}
+						if sy >= height {
+							sy = height - 1
+						}
+						pr, pg, pb, _ := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+						r, g, b := float64(pr), float64(pg), float64(pb)
+						cb += -0.168736*r - 0.331264*g + 0.5*b
+						cr += 0.5*r - 0.418688*g - 0.081312*b
+					}
+					samples[1][y*8+x] = cb / 4
+					samples[2][y*8+x] = cr / 4
+				}
+			}
+			block := by*blocksX[1] + bx
+			transform(&samples[1], 1, coefs[1][block*64:block*64+64])
+			transform(&samples[2], 1, coefs[2][block*64:block*64+64])
+		}
+	}
+
+	// Write headers: SOI, DQT, SOF2 and DHT
+	bw := &jpegBitWriter{w: bufio.NewWriter(w)}
+	bw.w.Write([]byte{0xff, 0xd8})
+	dqt := []byte{}
+	for i := range quant {
+		dqt = append(dqt, byte(i))
+		for j := range quant[i] {
+			dqt = append(dqt, byte(quant[i][j]))
+		}
+	}
+	writeJPEGSegment(bw.w, 0xdb, dqt)
+	writeJPEGSegment(bw.w, 0xc2, []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3, 1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1})
+	dht := []byte{}
+	for i, spec := range jpegHuffmanSpecs {
+		dht = append(dht, spec.class<<4|spec.id)
+		dht = append(dht, spec.count[:]...)
+		dht = append(dht, spec.value...)
+		// Build code lookup table for this spec
+		code, k := uint32(0), 0
+		for length := uint32(1); length <= 16; length++ {
+			for j := byte(0); j < spec.count[length-1]; j++ {
+				bw.huffman[i][spec.value[k]] = length<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	writeJPEGSegment(bw.w, 0xc4, dht)
+
+	// First scan holds DC coefficients of all components, following scans refine AC bands of one component each
+	scans := []struct {
+		components []int
+		start, end int
+	}{
+		{[]int{0, 1, 2}, 0, 0},
+		{[]int{0}, 1, 5},
+		{[]int{2}, 1, 63},
+		{[]int{1}, 1, 63},
+		{[]int{0}, 6, 63},
+	}
+	for _, scan := range scans {
+		sos := []byte{byte(len(scan.components))}
+		for _, c := range scan.components {
+			table := byte(0)
+			if c > 0 {
+				table = 1
+			}
+			sos = append(sos, byte(c+1), table<<4|table)
+		}
+		sos = append(sos, byte(scan.start), byte(scan.end), 0)
+		writeJPEGSegment(bw.w, 0xda, sos)
+		if scan.start == 0 {
+			// Interleaved DC scan, each MCU holds 2x2 luminance blocks followed by one block of each chrominance
+			var prevDC [3]int
+			for my := 0; my < mcusY; my++ {
+				for mx := 0; mx < mcusX; mx++ {
+					blocks := [6]int{(my*2)*blocksX[0] + mx*2, (my*2)*blocksX[0] + mx*2 + 1, (my*2+1)*blocksX[0] + mx*2, (my*2+1)*blocksX[0] + mx*2 + 1, my*blocksX[1] + mx, my*blocksX[2] + mx}
+					for i, block := range blocks {
+						c, table := 0, 0
+						if i >= 4 {
+							c, table = i-3, 2
+						}
+						dc := int(coefs[c][block*64])
+						bw.emitHuffRLE(table, 0, dc-prevDC[c])
+						prevDC[c] = dc
+					}
+				}
+			}
+		} else {
+			// Non-interleaved AC scan only covers blocks inside the component's own dimensions
+			c := scan.components[0]
+			table, componentWidth, componentHeight := 1, width, height
+			if c > 0 {
+				table, componentWidth, componentHeight = 3, (width+1)/2, (height+1)/2
+			}
+			for by := 0; by < (componentHeight+7)/8; by++ {
+				for bx := 0; bx < (componentWidth+7)/8; bx++ {
+					block := by*blocksX[c] + bx
+					data := coefs[c][block*64 : block*64+64]
+					runLength := 0
+					for k := scan.start; k <= scan.end; k++ {
+						if data[k] == 0 {
+							runLength++
+							continue
+						}
+						for runLength > 15 {
+							bw.emitHuff(table, 0xf0)
+							runLength -= 16
+						}
+						bw.emitHuffRLE(table, runLength, int(data[k]))
+						runLength = 0
+					}
+					if runLength > 0 {
+						// End of band, encoded as EOB run of one block
+						bw.emitHuff(table, 0x00)
+					}
+				}
+			}
+		}
+		bw.flush()
+	}
+
+	// Write EOI
+	bw.w.Write([]byte{0xff, 0xd9})
+	return bw.w.Flush()
+}
+
+// Function for encoding image as JPEG, progressive if enabled in config
+func encodeJPEG(w io.Writer, img image.Image, quality int) error {
+	config := getActiveConfig()
+	if config.ProgressiveJPEG {
+		return encodeProgressiveJPEG(w, img, quality)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// Function for resizing image to given size by averaging the covered source pixels
+func resizeImage(imgSrc image.Image, width int, height int) *image.RGBA {
+	bounds := imgSrc.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	pixel := getPixelReader(imgSrc)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			// Average all source pixels covered by this destination pixel
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Function for getting filename of the resized variant of a cached image
+func getResizedFilename(filename string, width int, height int) string {
+	extension := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, extension) + "_" + strconv.Itoa(width) + "x" + strconv.Itoa(height) + extension
+}
+
+// Function for detecting if a filename belongs to a resized variant of a cached image
+func isResizedImage(filename string) bool {
+	pattern := regexp.MustCompile(`_\d+x\d+\.(?i)(jpg|jpeg|png)$`)
+	return pattern.MatchString(filename)
+}
+
+// Function for getting requested resize width and height from query parameters, rounded up to one of ResizeSizes
+func getResizeParams(r *http.Request) (int, int) {
+	width, err := strconv.Atoi(r.URL.Query().Get("w"))
+	if err != nil || width < 0 {
+		width = 0
+	} else if width > MaxResizeWidth {
+		width = MaxResizeWidth
+	}
+	height, err := strconv.Atoi(r.URL.Query().Get("h"))
+	if err != nil || height < 0 {
+		height = 0
+	} else if height > MaxResizeHeight {
+		height = MaxResizeHeight
+	}
+	return getResizeSize(width), getResizeSize(height)
+}
+
+// Function for rounding a requested width or height up to the next of ResizeSizes, 0 stays 0
+func getResizeSize(size int) int {
+	if size == 0 {
+		return 0
+	}
+	for _, resizeSize := range ResizeSizes {
+		if size <= resizeSize {
+			return resizeSize
+		}
+	}
+	return ResizeSizes[len(ResizeSizes)-1]
+}
+
+// Function for creating (or reusing) a resized variant of a cached image, returns path of the file to serve
+func getResizedImage(filename string, width int, height int) (string, error) {
+	config := getActiveConfig()
+	// Resized variants are served as they are
+	if isResizedImage(filename) {
+		return filename, nil
+	}
+
+	// Fit requested size into the original size while keeping aspect ratio, never upscale
+	file, err := os.Open(filename)
+	if err != nil {
+		return filename, err
+	}
+	imgConfig, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return filename, err
+	}
+	srcWidth, srcHeight := imgConfig.Width, imgConfig.Height
+	targetWidth, targetHeight := srcWidth, srcHeight
+	if width > 0 && width < targetWidth {
+		targetHeight = targetHeight * width / targetWidth
+		targetWidth = width
+	}
+	if height > 0 && height < targetHeight {
+		targetWidth = targetWidth * height / targetHeight
+		targetHeight = height
+	}
+	if targetWidth < 1 {
+		targetWidth = 1
+	}
+	if targetHeight < 1 {
+		targetHeight = 1
+	}
+	if targetWidth == srcWidth && targetHeight == srcHeight {
+		// Requested size is not smaller than original, serve original
+		return filename, nil
+	}
+
+	// Variants are named by their actual size, so requests resulting in the same size share one
+	filenameResized := getResizedFilename(filename, targetWidth, targetHeight)
+	if resizedInfo, err := os.Stat(filenameResized); err == nil {
+		if originalInfo, err := os.Stat(filename); err == nil && !resizedInfo.ModTime().Before(originalInfo.ModTime()) {
+			return filenameResized, nil
+		}
+	}
+
+	// Decode original image, large images one at a time as compressImage does
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return filename, err
+	}
+	if srcWidth*srcHeight > LargeImagePixels {
+		largeImageSlot <- struct{}{}
+		defer func() { <-largeImageSlot }()
+	}
+	imgSrc, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return filename, err
+	}
+
+	// Resize and encode in the same format as the original file
+	newImg := resizeImage(imgSrc, targetWidth, targetHeight)
+	buf := bytes.Buffer{}
+	if getImgExtension(filename) == "png" {
+		err = png.Encode(&buf, newImg)
+	} else {
+		flatImg := image.NewRGBA(newImg.Bounds())
+		draw.Draw(flatImg, flatImg.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+		draw.Draw(flatImg, flatImg.Bounds(), newImg, image.Point{}, draw.Over)
+		err = encodeJPEG(&buf, flatImg, config.ImageQuality)
+	}
+	if err != nil {
+		return filename, err
+	}
+	// Variants take space in cache folder as well, the original being served is kept
+	evictForVariant(int64(buf.Len()), getCachedRelativeName(filename))
+	err = writeFileAtomic(filenameResized, buf.Bytes())
+	if err != nil {
+		return filename, err
+	}
+	// Original may have been removed while resizing, e.g. by purge, its variant must not outlive it
+	if _, err := os.Stat(filename); err != nil {
+		os.Remove(filenameResized)
+		return filename, err
+	}
+	addCachedFile(getCachedRelativeName(filenameResized))
+	slog.Debug("Created resized image", "filename", filenameResized)
+	return filenameResized, nil
+}
+
+// Function for getting the filename suffix encoding a non-default image quality
+func getQualitySuffix(quality int) string {
+	if quality == 0 {
+		return ""
+	}
+	return "_q" + strconv.Itoa(quality)
+}
+
+// Function for extracting image quality from a cached filename, 0 means default quality
+func getImgQuality(filename string) int {
+	pattern := regexp.MustCompile(`_q(\d{1,3})\.(?i)(jpg|jpeg|png)$`)
+	match := pattern.FindStringSubmatch(filename)
+	if len(match) >= 2 {
+		quality, err := strconv.Atoi(match[1])
+		if err == nil {
+			return quality
+		}
+	}
+	return 0
+}
+
+// Function for detecting if a cached filename matches requested quality (0 means default quality)
+func matchesQuality(filename string, quality int) bool {
+	config := getActiveConfig()
+	fileQuality := getImgQuality(filename)
+	if fileQuality == 0 {
+		fileQuality = config.ImageQuality
+	}
+	if quality == 0 {
+		quality = config.ImageQuality
+	}
+	return fileQuality == quality
+}
+
+// Function for getting orientation of an image from its dimensions
+func getOrientation(info ImageInfo) string {
+	ratio := float64(info.Width) / math.Max(1, float64(info.Height))
+	if ratio > 1+float64(SquareTolerancePercent)/100 {
+		return OrientationLandscape
+	} else if ratio < 1-float64(SquareTolerancePercent)/100 {
+		return OrientationPortrait
+	}
+	return OrientationSquare
+}
+
+// Function for detecting if an image matches requested orientation (empty string matches all)
+func matchesOrientation(info ImageInfo, orientation string) bool {
+	return orientation == "" || getOrientation(info) == orientation
+}
+
+// Function for detecting if a file is a valid and supported image
+func isImage(filename string) bool {
+	// Frist check if file extension is supported
+	if getImgExtension(filename) == "" {
+		return false
+	}
+	// Then check content type by opening and read it into buffer
+	filename = getCachedPath(filename)
+	imageFile, err := os.Open(filename)
+	if err != nil {
+		slog.Error("Failed to open image", "filename", filename, "error", err)
+		return false
+	}
+	defer imageFile.Close()
+	// Only take the first 512 bytes of the file to check the content type, shorter files are checked as they are
+	buff := make([]byte, 512)
+	n, err := io.ReadFull(imageFile, buff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		// Empty or unreadable file is not an image
+		return false
+	}
+	_, err = sniffImage(buff[:n])
+	return err == nil
+}
+
+// Function for opening image index of IndexBackend in config, replacing the index in use
+func loadImageIndex() error {
+	config := getActiveConfig()
+	var index ImageIndex
+	if config.IndexBackend == IndexBackendSQLite {
+		sqliteIndex, err := openSQLiteImageIndex(config.IndexDatabaseFileName)
+		if err != nil {
+			return err
+		}
+		if err := sqliteIndex.importJSONIndex(config.IndexFileName); err != nil {
+			sqliteIndex.Close()
+			return err
+		}
+		index = sqliteIndex
+	} else {
+		index = loadJSONImageIndex(config.IndexFileName)
+	}
+	if imageIndex != nil {
+		if err := imageIndex.Close(); err != nil {
+			slog.Error("Failed to close image index", "error", err)
+		}
+	}
+	imageIndex = index
+	return nil
+}
+
+// Function for checking whether an indexed image matches filter, resized variants never match
+func matchesImageFilter(filename string, info ImageInfo, filter ImageFilter) bool {
+	if isResizedImage(filename) || !matchesQuality(filename, filter.Quality) || !matchesOrientation(info, filter.Orientation) {
+		return false
+	}
+	if filter.Category != "" && !strings.HasPrefix(filename, filter.Category+"/") {
+		return false
+	}
+	if !filter.CachedAfter.IsZero() && !info.CachedAt.After(filter.CachedAfter) {
+		return false
+	}
+	return filter.CachedBefore.IsZero() || !info.CachedAt.After(filter.CachedBefore)
+}
+
+// Function for reading json image index from file, starting with an empty index if it does not exist or can't be parsed
+func loadJSONImageIndex(filename string) *JSONImageIndex {
+	index := &JSONImageIndex{FileName: filename, Images: map[string]*ImageInfo{}, IDs: map[string]string{}}
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to read image index", "file", filename, "error", err)
+		}
+		return index
+	}
+	err = json.Unmarshal(file, &index.Images)
+	if err != nil {
+		slog.Error("Failed to parse image index", "file", filename, "error", err)
+		index.Images = map[string]*ImageInfo{}
+	}
+	// Rebuild ID lookup
+	for filename, info := range index.Images {
+		if info.ID != "" {
+			index.IDs[info.ID] = filename
+		}
+	}
+	return index
+}
+
+// Function for getting metadata of an image in json index
+func (index *JSONImageIndex) Get(filename string) (ImageInfo, bool) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	info, ok := index.Images[filename]
+	if !ok {
+		return ImageInfo{}, false
+	}
+	return *info, true
+}
+
+// Function for getting filename of an image in json index by its ID
+func (index *JSONImageIndex) GetByID(id string) (string, bool) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	filename, ok := index.IDs[id]
+	return filename, ok
+}
+
+// Function for getting filenames of images in json index by sha256 hash of their content
+func (index *JSONImageIndex) GetByHash(hash string) []string {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	var filenames []string
+	for filename, info := range index.Images {
+		if info.Hash == hash && !isResizedImage(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// Function for changing metadata of an image in json index with update, adding the image first if create is set, saved to file later by Flush
+func (index *JSONImageIndex) Update(filename string, create bool, update func(info *ImageInfo)) (ImageInfo, bool) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	info, ok := index.Images[filename]
+	if !ok {
+		if !create {
+			return ImageInfo{}, false
+		}
+		info = &ImageInfo{}
+		index.Images[filename] = info
+	}
+	update(info)
+	if info.ID != "" {
+		index.IDs[info.ID] = filename
+	}
+	index.Dirty = true
+	return *info, true
+}
+
+// Function for recording that images in json index were served, saved to file later by Flush
+func (index *JSONImageIndex) MarkServed(filenames []string, servedAt time.Time) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	for _, filename := range filenames {
+		if info, ok := index.Images[filename]; ok {
+			info.LastServed = servedAt
+			info.ServeCount++
+			index.Dirty = true
+		}
+	}
+}
+
+// Function for removing an image from json index, saved to file later by Flush
+func (index *JSONImageIndex) Remove(filename string) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	info, ok := index.Images[filename]
+	if !ok {
+		return
+	}
+	if index.IDs[info.ID] == filename {
+		delete(index.IDs, info.ID)
+	}
+	delete(index.Images, filename)
+	index.Dirty = true
+}
+
+// Function for removing all images from json index, saved to file later by Flush
+func (index *JSONImageIndex) Clear() {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	index.Images = map[string]*ImageInfo{}
+	index.IDs = map[string]string{}
+	index.Dirty = true
+}
+
+// Function for calling fn with each image in json index until it returns false, fn may use the index
+func (index *JSONImageIndex) Range(fn func(filename string, info ImageInfo) bool) {
+	index.Lock.Lock()
+	infos := make(map[string]ImageInfo, len(index.Images))
+	for filename, info := range index.Images {
+		infos[filename] = *info
+	}
+	index.Lock.Unlock()
+	for filename, info := range infos {
+		if !fn(filename, info) {
+			return
+		}
+	}
+}
+
+// Function for getting filenames of images in json index matching filter, sorted by filename
+func (index *JSONImageIndex) Find(filter ImageFilter) []string {
+	index.Lock.Lock()
+	var filenames []string
+	for filename, info := range index.Images {
+		if matchesImageFilter(filename, *info, filter) {
+			filenames = append(filenames, filename)
+		}
+	}
+	index.Lock.Unlock()
+	sort.Strings(filenames)
+	return filenames
+}
+
+// Function for getting up to n random images in json index matching filter, skipping those exclude returns true for
+func (index *JSONImageIndex) Sample(filter ImageFilter, n int, exclude func(filename string) bool) []string {
+	filenames := index.Find(filter)
+	var sample []string
+	for _, i := range randomPerm(len(filenames)) {
+		if len(sample) >= n {
+			break
+		}
+		if !exclude(filenames[i]) {
+			sample = append(sample, filenames[i])
+		}
+	}
+	return sample
+}
+
+// Function for getting up to n images in json index in eviction order, least recently served first, images never served count as oldest once past grace period
+func (index *JSONImageIndex) Oldest(n int) []string {
+	graceStart := time.Now().Add(-time.Duration(EvictionGraceMinutes) * time.Minute)
+	index.Lock.Lock()
+	var filenames []string
+	lastServed := map[string]time.Time{}
+	cachedAt := map[string]time.Time{}
+	for filename, info := range index.Images {
+		if isResizedImage(filename) {
+			continue
+		}
+		filenames = append(filenames, filename)
+		lastServed[filename] = info.LastServed
+		if info.LastServed.IsZero() && info.CachedAt.After(graceStart) {
+			lastServed[filename] = info.CachedAt
+		}
+		cachedAt[filename] = info.CachedAt
+	}
+	index.Lock.Unlock()
+	sort.Slice(filenames, func(a, b int) bool {
+		if !lastServed[filenames[a]].Equal(lastServed[filenames[b]]) {
+			return lastServed[filenames[a]].Before(lastServed[filenames[b]])
+		}
+		return cachedAt[filenames[a]].Before(cachedAt[filenames[b]])
+	})
+	if len(filenames) > n {
+		filenames = filenames[:n]
+	}
+	return filenames
+}
+
+// Function for saving json index if it changed since it was saved, so batches of changes are written once
+func (index *JSONImageIndex) Flush() error {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+	if index.Dirty {
+		return index.save()
+	}
+	return nil
+}
+
+// Function for saving json index before it is replaced
+func (index *JSONImageIndex) Close() error {
+	return index.Flush()
+}
+
+// Function for saving json index to file (caller must hold index lock)
+func (index *JSONImageIndex) save() error {
+	index.Dirty = false
+	file, err := json.Marshal(index.Images)
+	if err != nil {
+		slog.Error("Failed to encode image index", "error", err)
+		return err
+	}
+	// Write to temporary file first so a crash never leaves a truncated index
+	err = ioutil.WriteFile(index.FileName+".tmp", file, 0644)
+	if err == nil {
+		err = os.Rename(index.FileName+".tmp", index.FileName)
+	}
+	if err != nil {
+		slog.Error("Failed to save image index", "file", index.FileName, "error", err)
+	}
+	return err
+}
+
+// Function for opening sqlite image index, creating the database file and its tables if they don't exist
+func openSQLiteImageIndex(filename string) (*SQLiteImageIndex, error) {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, sharing a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`PRAGMA journal_mode = WAL;
+		CREATE TABLE IF NOT EXISTS images (
+			filename TEXT PRIMARY KEY,
+			id TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			quality INTEGER NOT NULL,
+			orientation TEXT NOT NULL,
+			cached_at INTEGER NOT NULL,
+			last_served INTEGER NOT NULL,
+			serve_count INTEGER NOT NULL,
+			info TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS images_id ON images (id);
+		CREATE INDEX IF NOT EXISTS images_hash ON images (hash);
+		CREATE INDEX IF NOT EXISTS images_orientation ON images (orientation, quality);
+		CREATE INDEX IF NOT EXISTS images_last_served ON images (last_served, cached_at);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteImageIndex{FileName: filename, DB: db}, nil
+}
+
+// Function for importing images of json index file into sqlite index once, renaming the file afterwards so later runs skip it
+func (index *SQLiteImageIndex) importJSONIndex(filename string) error {
+	if _, err := os.Stat(filename); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	jsonIndex := loadJSONImageIndex(filename)
+	tx, err := index.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for filename, info := range jsonIndex.Images {
+		// Images already in sqlite index are newer than the json index
+		if err := putSQLiteImageInfo(tx, "INSERT OR IGNORE", filename, *info); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename, filename+".migrated"); err != nil {
+		return err
+	}
+	slog.Info("Migrated image index to sqlite", "from", filename, "to", index.FileName, "images", len(jsonIndex.Images))
+	return nil
+}
+
+// Function for getting unix time in nanoseconds as stored in sqlite index, 0 for zero time
+func getIndexTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// Function for writing metadata of an image to sqlite index with statement, one of INSERT OR REPLACE or INSERT OR IGNORE
+func putSQLiteImageInfo(tx *sql.Tx, statement string, filename string, info ImageInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(statement+` INTO images (filename, id, hash, quality, orientation, cached_at, last_served, serve_count, info) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		filename, info.ID, info.Hash, getImgQuality(filename), getOrientation(info), getIndexTime(info.CachedAt), getIndexTime(info.LastServed), info.ServeCount, string(data))
+	return err
+}
+
+// Function for reading metadata of an image from a row of sqlite index, last served time and count are kept in their own columns
+func scanSQLiteImageInfo(row interface{ Scan(...any) error }) (string, ImageInfo, error) {
+	var filename, data string
+	var lastServed, serveCount int64
+	if err := row.Scan(&filename, &data, &lastServed, &serveCount); err != nil {
+		return "", ImageInfo{}, err
+	}
+	var info ImageInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return "", ImageInfo{}, err
+	}
+	info.LastServed = time.Time{}
+	if lastServed != 0 {
+		info.LastServed = time.Unix(0, lastServed)
+	}
+	info.ServeCount = serveCount
+	return filename, info, nil
+}
+
+// Function for getting metadata of an image in sqlite index
+func (index *SQLiteImageIndex) Get(filename string) (ImageInfo, bool) {
+	_, info, err := scanSQLiteImageInfo(index.DB.QueryRow(`SELECT filename, info, last_served, serve_count FROM images WHERE filename = ?`, filename))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to read image index", "filename", filename, "error", err)
+		}
+		return ImageInfo{}, false
+	}
+	return info, true
+}
+
+// Function for getting filename of an image in sqlite index by its ID, the most recently cached one if several share it
+func (index *SQLiteImageIndex) GetByID(id string) (string, bool) {
+	var filename string
+	err := index.DB.QueryRow(`SELECT filename FROM images WHERE id = ? ORDER BY cached_at DESC LIMIT 1`, id).Scan(&filename)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to read image index", "id", id, "error", err)
+		}
+		return "", false
+	}
+	return filename, true
+}
+
+// Function for getting filenames of images in sqlite index by sha256 hash of their content
+func (index *SQLiteImageIndex) GetByHash(hash string) []string {
+	return index.queryFilenames(`SELECT filename FROM images WHERE hash = ?`, hash)
+}
+
+// Function for changing metadata of an image in sqlite index with update, adding the image first if create is set
+func (index *SQLiteImageIndex) Update(filename string, create bool, update func(info *ImageInfo)) (ImageInfo, bool) {
+	tx, err := index.DB.Begin()
+	if err != nil {
+		slog.Error("Failed to update image index", "filename", filename, "error", err)
+		return ImageInfo{}, false
+	}
+	defer tx.Rollback()
+	_, info, err := scanSQLiteImageInfo(tx.QueryRow(`SELECT filename, info, last_served, serve_count FROM images WHERE filename = ?`, filename))
+	if err != nil && (!errors.Is(err, sql.ErrNoRows) || !create) {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to read image index", "filename", filename, "error", err)
+		}
+		return ImageInfo{}, false
+	}
+	update(&info)
+	if err = putSQLiteImageInfo(tx, "INSERT OR REPLACE", filename, info); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.Error("Failed to update image index", "filename", filename, "error", err)
+		return ImageInfo{}, false
+	}
+	return info, true
+}
+
+// Function for recording that images in sqlite index were served
+func (index *SQLiteImageIndex) MarkServed(filenames []string, servedAt time.Time) {
+	tx, err := index.DB.Begin()
+	if err != nil {
+		slog.Error("Failed to update image index", "error", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, filename := range filenames {
+		if _, err = tx.Exec(`UPDATE images SET last_served = ?, serve_count = serve_count + 1 WHERE filename = ?`, getIndexTime(servedAt), filename); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		slog.Error("Failed to update image index", "error", err)
+	}
+}
+
+// Function for removing an image from sqlite index
+func (index *SQLiteImageIndex) Remove(filename string) {
+	if _, err := index.DB.Exec(`DELETE FROM images WHERE filename = ?`, filename); err != nil {
+		slog.Error("Failed to update image index", "filename", filename, "error", err)
+	}
+}
+
+// Function for removing all images from sqlite index
+func (index *SQLiteImageIndex) Clear() {
+	if _, err := index.DB.Exec(`DELETE FROM images`); err != nil {
+		slog.Error("Failed to update image index", "error", err)
+	}
+}
+
+// Function for calling fn with each image in sqlite index until it returns false, fn may use the index
+func (index *SQLiteImageIndex) Range(fn func(filename string, info ImageInfo) bool) {
+	rows, err := index.DB.Query(`SELECT filename, info, last_served, serve_count FROM images`)
+	if err != nil {
+		slog.Error("Failed to read image index", "error", err)
+		return
+	}
+	// Rows hold the only connection, so they are read completely before fn is called
+	var filenames []string
+	var infos []ImageInfo
+	for rows.Next() {
+		filename, info, err := scanSQLiteImageInfo(rows)
+		if err != nil {
+			slog.Error("Failed to read image index", "error", err)
+			continue
+		}
+		filenames = append(filenames, filename)
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to read image index", "error", err)
+	}
+	rows.Close()
+	for i, filename := range filenames {
+		if !fn(filename, infos[i]) {
+			return
+		}
+	}
+}
+
+// Function for getting where clause and its arguments selecting images of sqlite index matching filter
+func getSQLiteImageFilter(filter ImageFilter) (string, []any) {
+	config := getActiveConfig()
+	quality := filter.Quality
+	if quality == 0 {
+		quality = config.ImageQuality
+	}
+	// Images without quality in their name have default quality
+	where := `(quality = ? OR (quality = 0 AND ? = ?))`
+	args := []any{quality, quality, config.ImageQuality}
+	if filter.Category != "" {
+		where += ` AND substr(filename, 1, ?) = ?`
+		args = append(args, len(filter.Category)+1, filter.Category+"/")
+	}
+	if filter.Orientation != "" {
+		where += ` AND orientation = ?`
+		args = append(args, filter.Orientation)
+	}
+	if !filter.CachedAfter.IsZero() {
+		where += ` AND cached_at > ?`
+		args = append(args, getIndexTime(filter.CachedAfter))
+	}
+	if !filter.CachedBefore.IsZero() {
+		where += ` AND cached_at <= ?`
+		args = append(args, getIndexTime(filter.CachedBefore))
+	}
+	return where, args
+}
+
+// Function for getting filenames of images in sqlite index matching filter, sorted by filename
+func (index *SQLiteImageIndex) Find(filter ImageFilter) []string {
+	where, args := getSQLiteImageFilter(filter)
+	return index.queryFilenames(`SELECT filename FROM images WHERE `+where+` ORDER BY filename`, args...)
+}
+
+// Function for getting up to n random images in sqlite index matching filter, skipping those exclude returns true for, exclude must not use the index
+func (index *SQLiteImageIndex) Sample(filter ImageFilter, n int, exclude func(filename string) bool) []string {
+	where, args := getSQLiteImageFilter(filter)
+	rows, err := index.DB.Query(`SELECT filename FROM images WHERE `+where+` ORDER BY RANDOM()`, args...)
+	if err != nil {
+		slog.Error("Failed to read image index", "error", err)
+		return nil
+	}
+	defer rows.Close()
+	var sample []string
+	for len(sample) < n && rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			slog.Error("Failed to read image index", "error", err)
+			return sample
+		}
+		if !isResizedImage(filename) && !exclude(filename) {
+			sample = append(sample, filename)
+		}
+	}
+	return sample
+}
+
+// Function for getting up to n images in sqlite index in eviction order, least recently served first, images never served count as oldest once past grace period
+func (index *SQLiteImageIndex) Oldest(n int) []string {
+	graceStart := time.Now().Add(-time.Duration(EvictionGraceMinutes) * time.Minute)
+	return index.queryFilenames(`SELECT filename FROM images
+		ORDER BY CASE WHEN last_served = 0 AND cached_at > ? THEN cached_at ELSE last_served END, cached_at LIMIT ?`, getIndexTime(graceStart), n)
+}
+
+// Function for flushing sqlite index, nothing to do as changes are written as they happen
+func (index *SQLiteImageIndex) Flush() error {
+	return nil
+}
+
+// Function for closing database of sqlite index
+func (index *SQLiteImageIndex) Close() error {
+	return index.DB.Close()
+}
+
+// Function for getting filenames returned by a query of sqlite index, resized variants are skipped
+func (index *SQLiteImageIndex) queryFilenames(query string, args ...any) []string {
+	rows, err := index.DB.Query(query, args...)
+	if err != nil {
+		slog.Error("Failed to read image index", "error", err)
+		return nil
+	}
+	defer rows.Close()
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			slog.Error("Failed to read image index", "error", err)
+			return filenames
+		}
+		if !isResizedImage(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to read image index", "error", err)
+	}
+	return filenames
+}
+
+// Function for listing files in cache folder and its category and remote subfolders as paths relative to cache folder, limited to one category if not empty
+func getCachedFilenames(category string) ([]string, error) {
+	cachedFilesLock.Lock()
+	// Listing is kept in memory, updated on writes and removals, and refreshed by runCacheListingRefresher
+	if cachedFiles == nil || cachedFilesTime.IsZero() {
+		if err := refreshCachedFiles(); err != nil {
+			cachedFilesLock.Unlock()
+			if category != "" && errors.Is(err, os.ErrNotExist) {
+				// Nothing retrieved for this category yet
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	var filenames []string
+	for filename := range cachedFiles {
+		if category == "" || strings.HasPrefix(filename, category+"/") {
+			filenames = append(filenames, filename)
+		}
+	}
+	cachedFilesLock.Unlock()
+	// Keep order of listing stable for callers
+	sort.Strings(filenames)
+	if category == "" {
+		updateEffectiveMode(countCachedImages(filenames))
+	}
+	return filenames, nil
+}
+
+// Function for reading listing of cache folder from disk, only validating files not listed before (caller must hold cachedFilesLock)
+func refreshCachedFiles() error {
+	files, err := readCachedFiles(cachedFiles)
+	if err != nil {
+		return err
+	}
+	removeMissingImageInfo(cachedFiles, files)
+	cachedFiles = files
+	cachedFilesTime = time.Now()
+	return nil
+}
+
+// Function for reading listing of cache folder from disk without holding cachedFilesLock, keeping changes made by the cache meanwhile
+func updateCachedFiles() error {
+	cachedFilesLock.Lock()
+	known := map[string]bool{}
+	for filename, valid := range cachedFiles {
+		known[filename] = valid
+	}
+	cachedFilesLock.Unlock()
+	files, err := readCachedFiles(known)
+	if err != nil {
+		return err
+	}
+	cachedFilesLock.Lock()
+	defer cachedFilesLock.Unlock()
+	for filename, valid := range cachedFiles {
+		if _, ok := known[filename]; !ok {
+			// Written while disk was read
+			files[filename] = valid
+		}
+	}
+	for filename := range known {
+		if _, ok := cachedFiles[filename]; !ok {
+			// Removed while disk was read
+			delete(files, filename)
+			delete(known, filename)
+		}
+	}
+	removeMissingImageInfo(known, files)
+	cachedFiles = files
+	cachedFilesTime = time.Now()
+	return nil
+}
+
+// Function for listing cache folder on disk, validating and indexing images not in known listing
+func readCachedFiles(known map[string]bool) (map[string]bool, error) {
+	config := getActiveConfig()
+	// Images are at most two subfolders deep, in category and remote subfolder
+	filenames, err := listCachedFiles(config.CacheFolder, "", 2)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	for _, filename := range filenames {
+		valid, ok := known[filename]
+		if !ok {
+			valid = isImage(filename)
+			// Images are picked from index, so images added to cache folder by others are indexed before they are listed
+			if info, indexed := imageIndex.Get(filename); valid && !isResizedImage(filename) && (!indexed || info.Version < ImageIndexVersion) {
+				if _, err := analyzeCachedImage(filename); err != nil {
+					slog.Error("Failed to index cached image", "filename", filename, "error", err)
+				}
+			}
+		}
+		files[filename] = valid
+	}
+	return files, nil
+}
+
+// Function for removing images no longer in cache folder from index, checking whole index if there was no listing before
+func removeMissingImageInfo(known map[string]bool, files map[string]bool) {
+	var missing []string
+	if known == nil {
+		imageIndex.Range(func(filename string, info ImageInfo) bool {
+			if !files[filename] {
+				missing = append(missing, filename)
+			}
+			return true
+		})
+	} else {
+		for filename := range known {
+			if _, ok := files[filename]; !ok {
+				missing = append(missing, filename)
+			}
+		}
+	}
+	for _, filename := range missing {
+		removeImageInfo(filename)
+	}
+}
+
+// Function for reading listing of cache folder from disk every CacheListingRefreshSeconds until ctx is done
+func runCacheListingRefresher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(CacheListingRefreshSeconds) * time.Second):
+		}
+		if err := updateCachedFiles(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list cache folder", "error", err)
+		}
+	}
+}
+
+// Function for forcing listing of cache folder to be read from disk on next use
+func invalidateCachedFiles() {
+	cachedFilesLock.Lock()
+	defer cachedFilesLock.Unlock()
+	cachedFilesTime = time.Time{}
+}
+
+// Function for adding a file written to cache folder to in-memory listing, data written by the cache is always a valid image
+func addCachedFile(filename string) {
+	cachedFilesLock.Lock()
+	defer cachedFilesLock.Unlock()
+	if cachedFiles != nil {
+		cachedFiles[filename] = true
+	}
+}
+
+// Function for removing a file from in-memory listing of cache folder
+func removeCachedFile(filename string) {
+	cachedFilesLock.Lock()
+	defer cachedFilesLock.Unlock()
+	delete(cachedFiles, filename)
+}
+
+// Function for checking whether a listed file passed image validation when it was first listed
+func isValidCachedFile(filename string) bool {
+	cachedFilesLock.Lock()
+	defer cachedFilesLock.Unlock()
+	return cachedFiles[filename]
+}
+
+// Function for forgetting a cached image that was removed from disk by someone else
+func forgetCachedImage(filename string) {
+	slog.Warn("Cached image is missing, removing it from index", "filename", filename)
+	removeCachedFile(filename)
+	removeImageInfo(filename)
+	resetRecentImages()
+}
+
+// Function for listing files in folder and up to depth levels of its subfolders, prefixing names with prefix
+func listCachedFiles(folder string, prefix string, depth int) ([]string, error) {
+	config := getActiveConfig()
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, file := range files {
+		if !file.IsDir() {
+			filenames = append(filenames, prefix+file.Name())
+			continue
+		}
+		// Tmp folder is never listed
+		if depth == 0 || (prefix == "" && file.Name() == config.CacheTmpFolder) {
+			continue
+		}
+		subfilenames, err := listCachedFiles(folder+string(os.PathSeparator)+file.Name(), prefix+file.Name()+"/", depth-1)
+		if err != nil {
+			slog.Error("Failed to list cache subfolder", "folder", folder+string(os.PathSeparator)+file.Name(), "error", err)
+			continue
+		}
+		filenames = append(filenames, subfilenames...)
+	}
+	return filenames, nil
+}
+
+// Function for checking whether path relative to cache folder can be a cached image, at most two subfolders deep and never in tmp folder
+func isCachedImagePath(filename string) bool {
+	config := getActiveConfig()
+	parts := strings.Split(filename, "/")
+	if len(parts) > 3 || parts[0] == config.CacheTmpFolder {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// Function for getting path of a cached file from its name relative to cache folder, returns false if name is not a cached image path or the file resolves to outside of cache folder
+func getCachedImageFile(relativeName string) (string, bool) {
+	config := getActiveConfig()
+	if !isCachedImagePath(relativeName) || !filepath.IsLocal(filepath.FromSlash(relativeName)) {
+		return "", false
+	}
+	filename := getCachedPath(relativeName)
+	// Symlinks must not lead out of cache folder, missing files are left to callers
+	resolved, err := filepath.EvalSymlinks(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return filename, true
+	} else if err != nil {
+		return "", false
+	}
+	folder, err := filepath.EvalSymlinks(config.CacheFolder)
+	if err != nil {
+		return "", false
+	}
+	relativePath, err := filepath.Rel(folder, resolved)
+	if err != nil || !filepath.IsLocal(relativePath) {
+		return "", false
+	}
+	return filename, true
+}
+
+// Function for getting filename of a cached image by sha256 hash of its content, ignoring indexed files that no longer exist
+func getImageByHash(hash string) (string, bool) {
+	for _, filename := range imageIndex.GetByHash(hash) {
+		if _, err := os.Stat(getCachedPath(filename)); err == nil {
+			return filename, true
+		}
+	}
+	return "", false
+}
+
+// Function for getting path of a file in cache folder from its name relative to cache folder, as used in listing and index
+func getCachedPath(relativeName string) string {
+	config := getActiveConfig()
+	return config.CacheFolder + string(os.PathSeparator) + filepath.FromSlash(relativeName)
+}
+
+// Function for getting path relative to cache folder, as used in listing and index, of a path in cache folder
+func getCachedRelativeName(filename string) string {
+	config := getActiveConfig()
+	relativeName, err := filepath.Rel(config.CacheFolder, filename)
+	if err != nil {
+		return filepath.ToSlash(filename)
+	}
+	return filepath.ToSlash(relativeName)
+}
+
+// Function for writing image data to filename via a file in tmp folder, so the file only appears once fully written
+func writeFileAtomic(filename string, data []byte) error {
+	config := getActiveConfig()
+	// Never let data that is not a decodable image appear in cache folder
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return errors.New("Refused to cache data that is not a valid image, " + err.Error())
+	}
+	tmpFilename := getCachedPath(config.CacheTmpFolder + "/" + getTmpName() + filepath.Ext(filename))
+	// Writes not holding a retrieval slot, like resizing, are protected from purge this way
+	tmpFilesInUseLock.Lock()
+	tmpFilesInUse[tmpFilename] = true
+	tmpFilesInUseLock.Unlock()
+	defer func() {
+		tmpFilesInUseLock.Lock()
+		delete(tmpFilesInUse, tmpFilename)
+		tmpFilesInUseLock.Unlock()
+	}()
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
+
+// Function for checking whether a file in tmp folder is being written by writeFileAtomic
+func isTmpFileInUse(filename string) bool {
+	tmpFilesInUseLock.Lock()
+	defer tmpFilesInUseLock.Unlock()
+	return tmpFilesInUse[filename]
+}
+
+// Function for getting unique name for a file in tmp folder
+func getTmpName() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + strconv.FormatUint(tmpNameCounter.Add(1), 10)
+}
+
+// Function for counting cached images towards MaxCacheSize, ignoring resized variants and files that are not images
+func getCachedImageCount() (int, error) {
+	filenames, err := getCachedFilenames("")
+	if err != nil {
+		return 0, err
+	}
+	return countCachedImages(filenames), nil
+}
+
+// Function for counting images among cached filenames, ignoring resized variants and files that are not images
+func countCachedImages(filenames []string) int {
+	count := 0
+	for _, filename := range filenames {
+		if getImgExtension(filename) != "" && !isResizedImage(filename) {
+			count++
+		}
+	}
+	return count
+}
+
+// Function for getting mode currently in effect, which is local while cache is full and SwitchToLocalWhenFull is set
+func getEffectiveMode() Mode {
+	config := getActiveConfig()
+	if config.Mode == ModeRemote && config.SwitchToLocalWhenFull && switchedToLocal.Load() {
+		return ModeLocal
+	}
+	return config.Mode
+}
+
+// Function for switching effective mode to local once count cached images reach MaxCacheSize and back to remote once they drop below it
+func updateEffectiveMode(count int) {
+	config := getActiveConfig()
+	maxCount := getMaxCacheCount()
+	full := config.Mode == ModeRemote && config.SwitchToLocalWhenFull && maxCount != 0 && count >= maxCount
+	if switchedToLocal.Swap(full) == full {
+		return
+	}
+	if full {
+		slog.Info("Limit of MaxCacheSize reached, switching mode to local", "max_cache_size", maxCount)
+	} else {
+		slog.Info("Cache below limit of MaxCacheSize, switching mode back to remote", "max_cache_size", maxCount)
+	}
+}
+
+// Function for deleting a cached image together with its resized variants and index entry, returns number of bytes freed
+func removeCachedImage(filename string) (int64, error) {
+	path := getCachedPath(filename)
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Remove(path); err != nil {
+		return 0, err
+	}
+	freed := fileInfo.Size()
+	extension := filepath.Ext(path)
+	variants, _ := filepath.Glob(strings.TrimSuffix(path, extension) + "_*x*" + extension)
+	for _, variant := range variants {
+		if variantInfo, err := os.Stat(variant); err == nil && isResizedImage(variant) && os.Remove(variant) == nil {
+			freed += variantInfo.Size()
+			removeCachedFile(getCachedRelativeName(variant))
+		}
+	}
+	removeCachedFile(filename)
+	removeImageInfo(filename)
+	// Recent history may now point to missing files
+	resetRecentImages()
+	return freed, nil
+}
+
+// Function for deleting a cached image on request of an admin, filenames outside cached image folders are treated as not existing
+func deleteCachedImage(filename string) (int64, error) {
+	if getImgExtension(filename) == "" || isResizedImage(filename) {
+		return 0, os.ErrNotExist
+	}
+	if _, ok := getCachedImageFile(filename); !ok {
+		return 0, os.ErrNotExist
+	}
+	// Eviction must not remove the same image concurrently
+	evictionLock.Lock()
+	defer evictionLock.Unlock()
+	return removeCachedImage(filename)
+}
+
+// Function for deleting cached images and tmp files older than maxAge, or all of them if it is 0, keeping folders, returns number and total size of removed files
+func purgeCache(maxAge time.Duration) (int, int64, error) {
+	config := getActiveConfig()
+	// Retrievals write new files, so purge waits until it holds every retrieval slot
+	wait := time.Duration(config.RemoteTimeoutSec) * time.Second
+	for taken := 0; taken < cap(retrievalSlots); taken++ {
+		if !acquireRetrievalSlot(wait) {
+			for ; taken > 0; taken-- {
+				releaseRetrievalSlot()
+			}
+			return 0, 0, ErrRetrievalsBusy
+		}
+	}
+	defer func() {
+		for taken := 0; taken < cap(retrievalSlots); taken++ {
+			releaseRetrievalSlot()
+		}
+	}()
+	evictionLock.Lock()
+	defer evictionLock.Unlock()
+
+	invalidateCachedFiles()
+	filenames, err := getCachedFilenames("")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to list cache folder", "error", err)
+	}
+	getPath := func(filename string) string {
+		return getCachedPath(filename)
+	}
+	removed := 0
+	var removedSize int64
+	// Resized variants go first, so each removed file is counted, originals then take their index entry with them
+	for _, resized := range []bool{true, false} {
+		for _, filename := range filenames {
+			if getImgExtension(filename) == "" || isResizedImage(filename) != resized {
+				continue
+			}
+			fileInfo, err := os.Stat(getPath(filename))
+			if err != nil || time.Since(fileInfo.ModTime()) < maxAge {
+				continue
+			}
+			freed := fileInfo.Size()
+			if resized {
+				if err = os.Remove(getPath(filename)); err != nil {
+					slog.Error("Failed to remove resized image", "filename", filename, "error", err)
+					continue
+				}
+				removeCachedFile(filename)
+			} else {
+				freed, err = removeCachedImage(filename)
+				if err != nil {
+					slog.Error("Failed to remove cached image", "filename", filename, "error", err)
+					continue
+				}
+			}
+			removed++
+			removedSize += freed
+		}
+	}
+	tmpRemoved, tmpRemovedSize := cleanTmpFolder(maxAge)
+	removed += tmpRemoved
+	removedSize += tmpRemovedSize
+
+	// Without filter nothing is left, so index, histories and traffic counters start over
+	if maxAge == 0 {
+		servedFromCache.Store(0)
+		remoteFetches.Store(0)
+		imageIndex.Clear()
+		clientHistoriesLock.Lock()
+		clientHistories = map[string]*ClientHistory{}
+		clientHistoriesLock.Unlock()
+	}
+	resetRecentImages()
+	saveImageIndex()
+	invalidateCachedFiles()
+	if _, err := getCachedImageCount(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to count cached images", "error", err)
+	}
+	return removed, removedSize, nil
+}
+
+// Function for getting limit on number of cached images, MaxCacheSize is ignored when MaxCacheSizeMB is set
+func getMaxCacheCount() int {
+	config := getActiveConfig()
+	if config.MaxCacheSizeMB != 0 {
+		return 0
+	}
+	return config.MaxCacheSize
+}
+
+// Function for evicting least recently served cached images until one more image of size bytes fits into MaxCacheSizeMB or MaxCacheSize
+func evictForImage(size int64) {
+	evictForFile(size, 1, "")
+}
+
+// Function for evicting least recently served cached images other than its original until a resized variant of size bytes fits into MaxCacheSizeMB, variants don't count towards MaxCacheSize
+func evictForVariant(size int64, original string) {
+	evictForFile(size, 0, original)
+}
+
+// Function for evicting least recently served cached images except keep until a file of size bytes adding images images fits into MaxCacheSizeMB or MaxCacheSize
+func evictForFile(size int64, images int, keep string) {
+	config := getActiveConfig()
+	maxCount := getMaxCacheCount()
+	if config.MaxCacheSizeMB == 0 && (maxCount == 0 || config.SwitchToLocalWhenFull) {
+		return
+	}
+	evictionLock.Lock()
+	defer evictionLock.Unlock()
+
+	// Total size includes resized variants, only original images are evicted
+	filenames, err := getCachedFilenames("")
+	if err != nil {
+		slog.Error("Failed to list cache folder", "error", err)
+		return
+	}
+	imageCount := 0
+	var totalSize int64
+	for _, filename := range filenames {
+		fileInfo, err := os.Stat(getCachedPath(filename))
+		if err != nil {
+			continue
+		}
+		totalSize += fileInfo.Size()
+		if getImgExtension(filename) != "" && !isResizedImage(filename) {
+			imageCount++
+		}
+	}
+	maxSize := int64(config.MaxCacheSizeMB) * 1024 * 1024
+	fits := func() bool {
+		if config.MaxCacheSizeMB != 0 {
+			return totalSize+size <= maxSize
+		}
+		return imageCount+images <= maxCount
+	}
+	if fits() {
+		return
+	}
+
+	// Evict least recently served images first, images never served count as oldest once past grace period
+	limit := "MaxCacheSize"
+	if config.MaxCacheSizeMB != 0 {
+		limit = "MaxCacheSizeMB"
+	}
+	for _, filename := range imageIndex.Oldest(imageCount) {
+		if fits() {
+			break
+		}
+		if filename == keep {
+			continue
+		}
+		freed, err := removeCachedImage(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			forgetCachedImage(filename)
+			continue
+		} else if err != nil {
+			slog.Error("Failed to evict cached image", "filename", filename, "error", err)
+			continue
+		}
+		totalSize -= freed
+		imageCount--
+		slog.Info("Evicted image to stay within limit", "filename", filename, "freed", freed, "limit", limit)
+	}
+}
+
+// Function for removing files older than maxAge from tmp folder, returns number and total size of removed files
+func cleanTmpFolder(maxAge time.Duration) (int, int64) {
+	config := getActiveConfig()
+	folder := getCachedPath(config.CacheTmpFolder)
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list tmp folder", "folder", folder, "error", err)
+		}
+		return 0, 0
+	}
+	removed := 0
+	var removedSize int64
+	for _, file := range files {
+		// Recent files may still be written by a retrieval in progress
+		if file.IsDir() || time.Since(file.ModTime()) < maxAge || isTmpFileInUse(getCachedPath(config.CacheTmpFolder+"/"+file.Name())) {
+			continue
+		}
+		if err := os.Remove(getCachedPath(config.CacheTmpFolder + "/" + file.Name())); err != nil {
+			slog.Error("Failed to remove stale tmp file", "filename", file.Name(), "error", err)
+			continue
+		}
+		removed++
+		removedSize += file.Size()
+	}
+	return removed, removedSize
+}
+
+// Function for analyzing all cached images that are not (fully) in the index yet
+func indexCachedImages() {
+	filenames, err := getCachedFilenames("")
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list cache folder", "error", err)
+		}
+		return
+	}
+	for _, filename := range filenames {
+		if getImgExtension(filename) == "" || isResizedImage(filename) {
+			continue
+		}
+		getImageInfo(filename)
+	}
+}
+
+// Function for removing cached images with identical content, keeping the one cached first, returns number and total size of removed files
+func removeDuplicateImages() (int, int64) {
+	filenames, err := getCachedFilenames("")
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list cache folder", "error", err)
+		}
+		return 0, 0
+	}
+	kept := map[string]ImageInfo{}
+	keptNames := map[string]string{}
+	var duplicates []string
+	for _, filename := range filenames {
+		if getImgExtension(filename) == "" || isResizedImage(filename) {
+			continue
+		}
+		info := getImageInfo(filename)
+		if info.Hash == "" {
+			continue
+		}
+		other, ok := kept[info.Hash]
+		if !ok {
+			kept[info.Hash] = info
+			keptNames[info.Hash] = filename
+			continue
+		}
+		if info.CachedAt.Before(other.CachedAt) {
+			duplicates = append(duplicates, keptNames[info.Hash])
+			kept[info.Hash] = info
+			keptNames[info.Hash] = filename
+		} else {
+			duplicates = append(duplicates, filename)
+		}
+	}
+	removed := 0
+	var removedSize int64
+	for _, filename := range duplicates {
+		freed, err := removeCachedImage(filename)
+		if err != nil {
+			slog.Error("Failed to remove duplicate image", "filename", filename, "error", err)
+			continue
+		}
+		slog.Info("Removed duplicate image", "filename", filename)
+		removed++
+		removedSize += freed
+	}
+	return removed, removedSize
+}
+
+// Function for getting filename of a cached image by its ID
+func getImageByID(id string) (string, bool) {
+	return imageIndex.GetByID(id)
+}
+
+// Function for computing the average color of an image in #rrggbb form, transparency is composited on white
+func getAverageColor(imgSrc image.Image) string {
+	average := resizeImage(imgSrc, 1, 1)
+	r, g, b, a := average.Pix[0], average.Pix[1], average.Pix[2], average.Pix[3]
+	return fmt.Sprintf("#%02x%02x%02x", r+(0xff-a), g+(0xff-a), b+(0xff-a))
+}
+
+// Function for converting sRGB value to linear light
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Function for converting linear light to sRGB value
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// Function for encoding value as base83 string of given length
+func encodeBase83(value int, length int) string {
+	const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = characters[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+// Function for computing BlurHash of an image with given number of components
+func getBlurHash(imgSrc image.Image, xComponents int, yComponents int) string {
+	// BlurHash only needs a coarse version of the image
+	bounds := imgSrc.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > BlurHashSampleSize || height > BlurHashSampleSize {
+		if width > height {
+			width, height = BlurHashSampleSize, int(math.Max(1, float64(height*BlurHashSampleSize/width)))
+		} else {
+			width, height = int(math.Max(1, float64(width*BlurHashSampleSize/height))), BlurHashSampleSize
+		}
+	}
+	img := resizeImage(imgSrc, width, height)
+
+	// Compute DCT factors of each component
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					offset := img.PixOffset(x, y)
+					// Composite transparency on white
+					a := 0xff - img.Pix[offset+3]
+					factor[0] += basis * sRGBToLinear(img.Pix[offset]+a)
+					factor[1] += basis * sRGBToLinear(img.Pix[offset+1]+a)
+					factor[2] += basis * sRGBToLinear(img.Pix[offset+2]+a)
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	// Encode size flag, maximum AC value, DC and AC components
+	hash := encodeBase83((xComponents-1)+(yComponents-1)*9, 1)
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash += encodeBase83(quantisedMaximum, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+	hash += encodeBase83(linearToSRGB(factors[0][0])<<16+linearToSRGB(factors[0][1])<<8+linearToSRGB(factors[0][2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, v := range factor {
+			signPow := math.Copysign(math.Pow(math.Abs(v/maximumValue), 0.5), v)
+			value = value*19 + int(math.Max(0, math.Min(18, math.Floor(signPow*9+9.5))))
+		}
+		hash += encodeBase83(value, 2)
+	}
+	return hash
+}
+
+// Function for computing difference hash of an image in hex form, each bit tells whether brightness increases between neighbouring pixels
+func getPerceptualHash(imgSrc image.Image) string {
+	img := resizeImage(imgSrc, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if getBrightness(img, x, y) < getBrightness(img, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Function for getting brightness of a pixel, transparency is composited on white
+func getBrightness(img *image.RGBA, x int, y int) int {
+	offset := img.PixOffset(x, y)
+	a := 0xff - int(img.Pix[offset+3])
+	return 299*(int(img.Pix[offset])+a) + 587*(int(img.Pix[offset+1])+a) + 114*(int(img.Pix[offset+2])+a)
+}
+
+// Function for counting differing bits of two perceptual hashes, returns -1 if either is invalid
+func getHammingDistance(a string, b string) int {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return -1
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return -1
+	}
+	return mathbits.OnesCount64(x ^ y)
+}
+
+// Function for finding a cached image of given quality whose perceptual hash is closer than threshold, returns its filename and distance
+func findNearDuplicate(pHash string, quality int, threshold int) (string, int, bool) {
+	found := ""
+	foundDistance := 0
+	imageIndex.Range(func(filename string, info ImageInfo) bool {
+		if info.PHash == "" || !matchesQuality(filename, quality) {
+			return true
+		}
+		distance := getHammingDistance(pHash, info.PHash)
+		if distance < 0 || distance >= threshold {
+			return true
+		}
+		if _, err := os.Stat(getCachedPath(filename)); err == nil {
+			found, foundDistance = filename, distance
+			return false
+		}
+		return true
+	})
+	return found, foundDistance, found != ""
+}
+
+// Function for grouping cached images of the same quality whose perceptual hashes are closer than threshold, the image cached first is kept
+func getNearDuplicateClusters(threshold int) []NearDuplicateCluster {
+	filenames, err := getCachedFilenames("")
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list cache folder", "error", err)
+		}
+		return nil
+	}
+	var images []string
+	infos := map[string]ImageInfo{}
+	for _, filename := range filenames {
+		if getImgExtension(filename) == "" || isResizedImage(filename) {
+			continue
+		}
+		info := getImageInfo(filename)
+		if info.PHash == "" {
+			continue
+		}
+		images = append(images, filename)
+		infos[filename] = info
+	}
+	sort.SliceStable(images, func(a, b int) bool {
+		return infos[images[a]].CachedAt.Before(infos[images[b]].CachedAt)
+	})
+	var clusters []NearDuplicateCluster
+	for _, filename := range images {
+		found := false
+		for i := range clusters {
+			kept := clusters[i].Kept
+			distance := getHammingDistance(infos[filename].PHash, infos[kept].PHash)
+			if getImgQuality(filename) == getImgQuality(kept) && distance >= 0 && distance < threshold {
+				clusters[i].Duplicates = append(clusters[i].Duplicates, filename)
+				found = true
+				break
+			}
+		}
+		if !found {
+			clusters = append(clusters, NearDuplicateCluster{Kept: filename})
+		}
+	}
+	result := []NearDuplicateCluster{}
+	for _, cluster := range clusters {
+		if len(cluster.Duplicates) > 0 {
+			result = append(result, cluster)
+		}
+	}
+	return result
+}
+
+// Function for analyzing image data and storing the results in image index
+func indexImage(filename string, data []byte, cachedAt time.Time) ImageInfo {
+	imgSrc, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		slog.Error("Failed to analyze image", "filename", filename, "error", err)
+		return ImageInfo{}
+	}
+	hash := sha256.Sum256(data)
+	id := hex.EncodeToString(hash[:])[:ImageIDLength]
+	dominantColor := getAverageColor(imgSrc)
+	blurHash := getBlurHash(imgSrc, BlurHashXComponents, BlurHashYComponents)
+	pHash := getPerceptualHash(imgSrc)
+	// Remember file modification time to detect replaced files
+	var modTime time.Time
+	if fileInfo, err := os.Stat(getCachedPath(filename)); err == nil {
+		modTime = fileInfo.ModTime()
+	}
+
+	// Update analyzed fields, keeping any other metadata of existing entry
+	info, _ := imageIndex.Update(filename, true, func(info *ImageInfo) {
+		info.Version = ImageIndexVersion
+		info.ID = id
+		info.Width = imgSrc.Bounds().Dx()
+		info.Height = imgSrc.Bounds().Dy()
+		info.Format = format
+		info.Size = int64(len(data))
+		info.Hash = hex.EncodeToString(hash[:])
+		info.ModTime = modTime
+		if info.CachedAt.IsZero() {
+			info.CachedAt = cachedAt
+		}
+		info.DominantColor = dominantColor
+		info.BlurHash = blurHash
+		info.PHash = pHash
+	})
+	return info
+}
+
+// Function for storing where a cached image came from, and its original filename taken from the URL it was downloaded from
+func setImageSource(filename string, remoteURL string, imgURL string) {
+	originalName := ""
+	if parsedURL, err := url.Parse(imgURL); err == nil {
+		originalName = sanitizeFilename(path.Base(parsedURL.Path))
+	}
+	imageIndex.Update(filename, false, func(info *ImageInfo) {
+		info.SourceRemote = remoteURL
+		info.SourceURL = imgURL
+		if originalName != "" {
+			info.OriginalName = originalName
+		}
+	})
+}
+
+// Function for removing credentials and query string from a URL, as remote URLs may contain API keys
+func getRedactedURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	parsedURL.User = nil
+	parsedURL.RawQuery = ""
+	return parsedURL.String()
+}
+
+// Function for recording that cached images were served and counting it, saved to index file later by saveImageIndex
+func markImagesServed(filenames []string) {
+	imageIndex.MarkServed(filenames, time.Now())
+}
+
+// Function for getting serve statistics of cached images, most served first
+func getImageStats() []ImageStats {
+	filenames, err := getCachedFilenames("")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to list cache folder", "error", err)
+	}
+	stats := []ImageStats{}
+	for _, filename := range filenames {
+		if info, ok := imageIndex.Get(filename); ok {
+			stats = append(stats, ImageStats{Filename: filename, ID: info.ID, ServeCount: info.ServeCount, LastServed: info.LastServed})
+		}
+	}
+	sort.SliceStable(stats, func(a, b int) bool {
+		if stats[a].ServeCount != stats[b].ServeCount {
+			return stats[a].ServeCount > stats[b].ServeCount
+		}
+		return stats[a].LastServed.After(stats[b].LastServed)
+	})
+	return stats
+}
+
+// Function for serving the n most and least served cached images as json
+func serveTopImages(w http.ResponseWriter, r *http.Request) {
+	// Statistics reveal what clients look at, so only admins can see them
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := DefaultTopImages
+	if r.URL.Query().Get("n") != "" {
+		var err error
+		n, err = strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 1 || n > MaxTopImages {
+			http.Error(w, "Invalid n, must be between 1 and "+strconv.Itoa(MaxTopImages), http.StatusBadRequest)
+			return
+		}
+	}
+	stats := getImageStats()
+	if n > len(stats) {
+		n = len(stats)
+	}
+	least := make([]ImageStats, n)
+	for i := range least {
+		least[i] = stats[len(stats)-1-i]
+	}
+	writeJSON(w, http.StatusOK, TopImagesResponse{MostServed: stats[:n], LeastServed: least})
+}
+
+// Function for saving image index if it changed since it was saved
+func saveImageIndex() {
+	if err := imageIndex.Flush(); err != nil {
+		slog.Error("Failed to save image index", "error", err)
+	}
+}
+
+// Function for saving image index every IndexSaveSeconds, and once more when ctx is done
+func runImageIndexSaver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			saveImageIndex()
+			return
+		case <-time.After(time.Duration(IndexSaveSeconds) * time.Second):
+		}
+		saveImageIndex()
+	}
+}
+
+// Function for checking whether a cached image is older than CacheTTLHours, using its cache time in image index
+func isExpiredImage(filename string) bool {
+	config := getActiveConfig()
+	if config.CacheTTLHours == 0 {
+		return false
+	}
+	info, ok := imageIndex.Get(filename)
+	if !ok || info.CachedAt.IsZero() {
+		return false
+	}
+	return time.Since(info.CachedAt) > time.Duration(config.CacheTTLHours)*time.Hour
+}
+
+// Function for removing a cached image from the index
+func removeImageInfo(filename string) {
+	imageIndex.Remove(filename)
+}
+
+// Function for sanitizing a filename for use in headers, removing path separators, quotes and control characters
+func sanitizeFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '"' || r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return strings.TrimSpace(filename)
+}
+
+// Function for setting Content-Disposition header of a cached image, using its original filename if known
+func setContentDisposition(w http.ResponseWriter, r *http.Request, filename string, info ImageInfo) {
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
+	} else if info.OriginalName == "" {
+		return
+	}
+	name := filepath.Base(filename)
+	if info.OriginalName != "" {
+		// Keep original name but use extension of the format actually served
+		name = strings.TrimSuffix(info.OriginalName, path.Ext(info.OriginalName)) + path.Ext(name)
+	}
+	// FormatMediaType takes care of quoting and encoding non-ASCII names
+	header := mime.FormatMediaType(disposition, map[string]string{"filename": name})
+	if header != "" {
+		w.Header().Set("Content-Disposition", header)
+	}
+}
+
+// Function for getting metadata of a cached image, analyzing it first if it is not (fully) in the index yet
+func getImageInfo(filename string) ImageInfo {
+	info, ok := imageIndex.Get(filename)
+	if ok && info.Version >= ImageIndexVersion {
+		return info
+	}
+	info, err := analyzeCachedImage(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		forgetCachedImage(filename)
+	} else if err != nil {
+		slog.Error("Failed to analyze cached image", "filename", filename, "error", err)
+	}
+	return info
+}
+
+// Function for analyzing a cached image and storing the results in image index, using file modification time as cache time
+func analyzeCachedImage(filename string) (ImageInfo, error) {
+	fileInfo, err := os.Stat(getCachedPath(filename))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	data, err := ioutil.ReadFile(getCachedPath(filename))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return indexImage(filename, data, fileInfo.ModTime()), nil
+}
+
+// Function for getting metadata of a cached image, analyzing it again if the file was replaced since it was indexed
+func getCurrentImageInfo(filename string, fileInfo os.FileInfo) ImageInfo {
+	info := getImageInfo(filename)
+	if info.Size == fileInfo.Size() && info.ModTime.Equal(fileInfo.ModTime()) {
+		return info
+	}
+	data, err := ioutil.ReadFile(getCachedPath(filename))
+	if err != nil {
+		slog.Error("Failed to read cached image", "filename", filename, "error", err)
+		return ImageInfo{}
+	}
+	return indexImage(filename, data, fileInfo.ModTime())
+}
+
+// Function for checking if an image is among the recently served ones
+func isRecentImage(filename string) bool {
+	recentImagesLock.Lock()
+	defer recentImagesLock.Unlock()
+	for _, recent := range recentImages {
+		if recent == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for recording served images, keeping only the last RecentHistorySize ones
+func addRecentImages(filenames []string) {
+	config := getActiveConfig()
+	recentImagesLock.Lock()
+	defer recentImagesLock.Unlock()
+	recentImages = append(recentImages, filenames...)
+	if len(recentImages) > config.RecentHistorySize {
+		recentImages = append([]string(nil), recentImages[len(recentImages)-config.RecentHistorySize:]...)
+	}
+}
+
+// Function for forgetting recently served images, used when files are evicted from cache
+func resetRecentImages() {
+	recentImagesLock.Lock()
+	defer recentImagesLock.Unlock()
+	recentImages = nil
+}
+
+// Function for checking if an image was served to a client
+func isClientImage(client string, filename string) bool {
+	clientHistoriesLock.Lock()
+	defer clientHistoriesLock.Unlock()
+	history, ok := clientHistories[client]
+	return ok && history.Served[filename]
+}
+
+// Function for recording images served to a client, expiring idle clients and forgetting least recently active ones
+func addClientImages(client string, filenames []string) {
+	config := getActiveConfig()
+	clientHistoriesLock.Lock()
+	defer clientHistoriesLock.Unlock()
+	now := time.Now()
+	history, ok := clientHistories[client]
+	if !ok {
+		// Remove expired histories before adding a new one
+		idle := time.Duration(config.ClientHistoryIdleMinutes) * time.Minute
+		for key, other := range clientHistories {
+			if now.Sub(other.LastSeen) > idle {
+				delete(clientHistories, key)
+			}
+		}
+		// Remove least recently active history if still full
+		if len(clientHistories) >= MaxClientHistories {
+			oldest := ""
+			for key, other := range clientHistories {
+				if oldest == "" || other.LastSeen.Before(clientHistories[oldest].LastSeen) {
+					oldest = key
+				}
+			}
+			delete(clientHistories, oldest)
+		}
+		history = &ClientHistory{Served: map[string]bool{}}
+		clientHistories[client] = history
+	}
+	history.LastSeen = now
+	for _, filename := range filenames {
+		history.Served[filename] = true
+	}
+}
+
+// Function for taking a token from bucket of client, returns whether one was available and otherwise how long until the next one
+func takeRateLimitToken(client string) (bool, time.Duration) {
+	config := getActiveConfig()
+	rateLimitBucketsLock.Lock()
+	defer rateLimitBucketsLock.Unlock()
+	now := time.Now()
+	burst := float64(config.RateLimitBurst)
+	bucket, ok := rateLimitBuckets[client]
+	if !ok {
+		if len(rateLimitBuckets) >= MaxRateLimitClients {
+			// Buckets refilled completely carry no state and can be removed
+			for key, other := range rateLimitBuckets {
+				if other.Tokens+now.Sub(other.LastSeen).Seconds()*config.RateLimitPerSecond >= burst {
+					delete(rateLimitBuckets, key)
+				}
+			}
+		}
+		// Remove least recently active bucket if still full
+		if len(rateLimitBuckets) >= MaxRateLimitClients {
+			oldest := ""
+			for key, other := range rateLimitBuckets {
+				if oldest == "" || other.LastSeen.Before(rateLimitBuckets[oldest].LastSeen) {
+					oldest = key
+				}
+			}
+			delete(rateLimitBuckets, oldest)
+		}
+		bucket = &TokenBucket{Tokens: burst, LastSeen: now}
+		rateLimitBuckets[client] = bucket
+	}
+	bucket.Tokens = math.Min(burst, bucket.Tokens+now.Sub(bucket.LastSeen).Seconds()*config.RateLimitPerSecond)
+	bucket.LastSeen = now
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.Tokens) / config.RateLimitPerSecond * float64(time.Second))
+}
+
+// Function for wrapping handler to limit requests of each client IP to RateLimitPerSecond, health checks are not limited
+func limitRate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := getActiveConfig()
+		if config.RateLimitPerSecond == 0 || r.URL.Path == config.PathPrefix+"/healthz" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := takeRateLimitToken(getClientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Function for replacing slots of concurrently handled requests with limit slots, requests in progress keep their old slots until they finish
+func setRequestSlots(limit int) {
+	if limit == 0 {
+		requestSlots.Store(nil)
+		return
+	}
+	slots := make(chan struct{}, limit)
+	requestSlots.Store(&slots)
+}
+
+// Function for wrapping handler to run at most MaxConcurrentRequests requests at once, queueing up to MaxQueuedRequests for RequestQueueTimeoutSec and rejecting others, health checks are not limited
+func limitConcurrency(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := getActiveConfig()
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Add(-1)
+		// Slot is returned to the slots it was taken from, even if they were replaced by reload meanwhile
+		slotsPointer := requestSlots.Load()
+		if slotsPointer == nil || r.URL.Path == config.PathPrefix+"/healthz" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		reject := func() {
+			rejectedRequests.Add(1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		}
+		slots := *slotsPointer
+		select {
+		case slots <- struct{}{}:
+		default:
+			// All slots taken, wait in queue if it has room
+			if queuedRequests.Add(1) > int64(config.MaxQueuedRequests) {
+				queuedRequests.Add(-1)
+				reject()
+				return
+			}
+			timer := time.NewTimer(time.Duration(config.RequestQueueTimeoutSec) * time.Second)
+			select {
+			case slots <- struct{}{}:
+				timer.Stop()
+				queuedRequests.Add(-1)
+			case <-timer.C:
+				queuedRequests.Add(-1)
+				reject()
+				return
+			case <-r.Context().Done():
+				// Client gave up waiting
+				timer.Stop()
+				queuedRequests.Add(-1)
+				return
+			}
+		}
+		defer func() { <-slots }()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Function for forgetting images served to a client
+func resetClientImages(client string) {
+	clientHistoriesLock.Lock()
+	defer clientHistoriesLock.Unlock()
+	if history, ok := clientHistories[client]; ok {
+		history.Served = map[string]bool{}
+	}
+}
+
+// Function for picking up to request.Count distinct random images matching request from cache folder
+func pickCachedImages(request ImageRequest) []string {
+	config := getActiveConfig()
+	// Images are picked from index only, which is kept in line with cache folder on writes, removals and listing refreshes, expired images are never served
+	filter := ImageFilter{Category: request.Category, Quality: request.Quality, Orientation: request.Orientation}
+	if config.CacheTTLHours != 0 {
+		filter.CachedAfter = time.Now().Add(-time.Duration(config.CacheTTLHours) * time.Hour)
+		// Expired images are removed as soon as they are encountered
+		expiredFilter := filter
+		expiredFilter.CachedAfter, expiredFilter.CachedBefore = time.Time{}, filter.CachedAfter
+		for _, filename := range imageIndex.Find(expiredFilter) {
+			// Eviction, purge or another request may be removing the same image
+			evictionLock.Lock()
+			_, err := removeCachedImage(filename)
+			evictionLock.Unlock()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				slog.Error("Failed to remove expired image", "filename", filename, "error", err)
+			} else {
+				slog.Info("Removed expired image", "filename", filename)
+			}
+		}
+	}
+	var picked []string
+	if request.Seed != "" {
+		// Use a private source derived from seed and sorted file list for deterministic picks
+		candidates := imageIndex.Find(filter)
+		hash := sha256.Sum256([]byte(request.Seed + "\x00" + strings.Join(candidates, "\x00")))
+		intn := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(hash[:8])))).Intn
+		for len(candidates) > 0 && len(picked) < request.Count {
+			fileIndex := intn(len(candidates))
+			picked = append(picked, candidates[fileIndex])
+			candidates = append(candidates[:fileIndex], candidates[fileIndex+1:]...)
+		}
+	} else {
+		// Sample images not picked yet, each call only if previous ones didn't find enough
+		sample := func(exclude func(filename string) bool) {
+			if len(picked) >= request.Count {
+				return
+			}
+			picked = append(picked, imageIndex.Sample(filter, request.Count-len(picked), func(filename string) bool {
+				return containsString(picked, filename) || exclude(filename)
+			})...)
+		}
+		// Prefer images not served to the client and not served recently, recent images are only used if there are too few others
+		seen := func(filename string) bool {
+			return request.Client != "" && isClientImage(request.Client, filename)
+		}
+		sample(func(filename string) bool {
+			return seen(filename) || isRecentImage(filename)
+		})
+		sample(seen)
+		// Start over once client has seen all images
+		if len(picked) == 0 && request.Client != "" {
+			resetClientImages(request.Client)
+			sample(isRecentImage)
+			sample(func(filename string) bool {
+				return false
+			})
+		}
+	}
+
+	// No image found, retrieve from remote later
+	if len(picked) == 0 {
+		slog.Warn("No image found in cache folder", "category", request.Category, "orientation", request.Orientation)
+	}
+	return picked
+}
+
+// Function for getting random int in [0, n) from shared random source
+func randomIntn(n int) int {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Intn(n)
+}
+
+// Function for getting random float64 in [0, 1) from shared random source
+func randomFloat64() float64 {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Float64()
+}
+
+// Function for getting random permutation of [0, n) from shared random source
+func randomPerm(n int) []int {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Perm(n)
+}
+
+// Function for parsing and validating query parameters of a request to root endpoint
+func getImageRequest(r *http.Request) (ImageRequest, error) {
+	config := getActiveConfig()
+	request := ImageRequest{Count: 1}
+	var err error
+	request.BaseURL, err = getRequestBaseURL(r)
+	if err != nil {
+		return request, err
+	}
+
+	// Get requested image quality, 0 means default quality in config
+	if r.URL.Query().Get("quality") != "" {
+		request.Quality, err = strconv.Atoi(r.URL.Query().Get("quality"))
+		if err != nil || request.Quality < 1 || request.Quality > 100 {
+			return request, errors.New("Invalid quality, must be between 1 and 100")
+		}
+	}
+
+	// Get requested response type, default is ServeMode in config
+	request.ServeMode, err = getServeMode(r)
+	if err != nil {
+		return request, err
+	}
+
+	// Get requested orientation
+	request.Orientation = r.URL.Query().Get("orientation")
+	if request.Orientation != "" && request.Orientation != OrientationLandscape && request.Orientation != OrientationPortrait && request.Orientation != OrientationSquare {
+		return request, errors.New("Invalid orientation, must be one of landscape, portrait, square")
+	}
+
+	// Get requested category, validated against remotes by caller
+	request.Category = r.URL.Query().Get("category")
+
+	// Get seed for deterministic selection
+	request.Seed = r.URL.Query().Get("seed")
+
+	// Get client key for per-client history, from query parameter or cookie
+	request.Client = r.URL.Query().Get("client")
+	if request.Client == "" {
+		if cookie, err := r.Cookie(ClientCookieName); err == nil {
+			request.Client = cookie.Value
+		}
+	}
+
+	// Get requested number of images, capped at MaxCount
+	if r.URL.Query().Get("count") != "" {
+		request.Count, err = strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || request.Count < 1 {
+			return request, errors.New("Invalid count, must be a positive integer")
+		}
+		if request.ServeMode != ServeModeLink && request.ServeMode != ServeModeJson {
+			return request, errors.New("Invalid count, only supported for link and json types")
+		}
+		if request.Count > config.MaxCount {
+			request.Count = config.MaxCount
+		}
+		request.List = true
+	}
+	return request, nil
+}
+
+// Function for checking whether host, with or without port, is in AllowedHosts, every host is allowed if the list is empty
+func isAllowedHost(host string) bool {
+	config := getActiveConfig()
+	if len(config.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	hostname := host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		hostname = name
+	}
+	return containsString(config.AllowedHosts, host) || containsString(config.AllowedHosts, hostname)
+}
+
+// Function for getting base URL of generated links including PathPrefix, either BaseURL in config or scheme and host the client used to reach the server, honoring headers of trusted proxies, returns error if that host is not in AllowedHosts
+func getRequestBaseURL(r *http.Request) (string, error) {
+	config := getActiveConfig()
+	if config.BaseURL != "" {
+		return config.BaseURL + config.PathPrefix, nil
+	}
+	if len(config.ACMEDomains) > 0 {
+		// Certificates only cover configured domains, so links always point to one of them
+		host := strings.ToLower(r.Host)
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if !containsString(config.ACMEDomains, host) {
+			host = config.ACMEDomains[0]
+		}
+		return "https://" + host + config.PathPrefix, nil
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	// Any client can send forwarding headers, only those set by trusted proxies are used
+	if isFromTrustedProxy(r) {
+		if proto := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	// Reflected hosts end up in links given to clients, so only trusted ones are used
+	if !isAllowedHost(host) {
+		return "", errors.New("Host " + host + " is not allowed")
+	}
+	return scheme + "://" + host + config.PathPrefix, nil
+}
+
+// Function for getting the public link of a cached image
+func getCachedImageLink(baseURL string, filename string) string {
+	config := getActiveConfig()
+	return baseURL + "/" + config.CacheFolder + "/" + filename
+}
+
+// Function for serving robots.txt from RobotsFile, or one keeping crawlers away from cached images if it is not set
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if config.RobotsFile != "" {
+		robots, err := ioutil.ReadFile(config.RobotsFile)
+		if err == nil {
+			w.Write(robots)
+			return
+		}
+		getLogger(r.Context()).Error("Failed to read robots file", "file", config.RobotsFile, "error", err)
+	}
+	fmt.Fprintf(w, "User-agent: *\nDisallow: %s/%s/\nDisallow: %s/img/\n", config.PathPrefix, config.CacheFolder, config.PathPrefix)
+}
+
+// Function for serving FaviconFile, or the built-in icon if enabled, with long cache headers
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	var favicon []byte
+	contentType := "image/x-icon"
+	if config.FaviconFile != "" {
+		data, err := ioutil.ReadFile(config.FaviconFile)
+		if err != nil {
+			getLogger(r.Context()).Error("Failed to read favicon file", "file", config.FaviconFile, "error", err)
+		} else {
+			favicon = data
+			contentType = mime.TypeByExtension(filepath.Ext(config.FaviconFile))
+			if contentType == "" {
+				contentType = http.DetectContentType(data)
+			}
+		}
+	}
+	if favicon == nil && *config.DefaultFavicon {
+		favicon = defaultFavicon
+	}
+	if favicon == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(FaviconMaxAgeSeconds))
+	w.Write(favicon)
+}
+
+// Function for serving metadata of a cached image given by path relative to cache folder, including where it came from
+func serveCacheInfo(w http.ResponseWriter, r *http.Request, filename string) {
+	if getImgExtension(filename) == "" || isResizedImage(filename) {
+		http.NotFound(w, r)
+		return
+	}
+	cachedFile, ok := getCachedImageFile(filename)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fileInfo, err := os.Stat(cachedFile)
+	if err != nil || fileInfo.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	baseURL, err := getRequestBaseURL(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	info := getCurrentImageInfo(filename, fileInfo)
+	// Remotes serving images directly, or embedding them as data, are the source URL themselves
+	sourceURL := info.SourceURL
+	if sourceURL == info.SourceRemote {
+		sourceURL = getRedactedURL(sourceURL)
+	}
+	writeJSON(w, http.StatusOK, CacheInfoResponse{
+		ID:           info.ID,
+		Filename:     filename,
+		URL:          getCachedImageLink(baseURL, filename),
+		SourceRemote: getRedactedURL(info.SourceRemote),
+		SourceURL:    sourceURL,
+		OriginalName: info.OriginalName,
+		CachedAt:     info.CachedAt,
+		Width:        info.Width,
+		Height:       info.Height,
+		Size:         info.Size,
+		Format:       info.Format,
+		Hash:         info.Hash,
+	})
+}
+
+// Function for writing a value as json response with given status code
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		slog.Error("Failed to write json response", "error", err)
+	}
+}
+
+// Function for checking whether client asked for json, by format query parameter or Accept header
+func wantsJSON(r *http.Request) bool {
+	// Explicit format takes precedence over Accept header
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == string(ServeModeJson)
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for writing error message with status code, as json if client asked for it and as plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, statusCode, map[string]string{"error": message})
+		return
+	}
+	http.Error(w, message, statusCode)
+}
+
+// Function for getting ServeMode requested via format/type query parameters, defaults to ServeMode in config
+func getServeMode(r *http.Request) (Mode, error) {
+	config := getActiveConfig()
+	switch r.URL.Query().Get("format") {
+	case "", "text":
+	case string(ServeModeJson):
+		return ServeModeJson, nil
+	default:
+		return "", errors.New("Invalid format, must be one of text, json")
+	}
+	switch r.URL.Query().Get("type") {
+	case "":
+		return config.ServeMode, nil
+	case "image", string(ServeModeFile):
+		return ServeModeFile, nil
+	case string(ServeModeLink):
+		return ServeModeLink, nil
+	case string(ServeModeRedirect):
+		return ServeModeRedirect, nil
+	case string(ServeModeHtml):
+		return ServeModeHtml, nil
+	case string(ServeModeJson):
+		return ServeModeJson, nil
+	}
+	return "", errors.New("Invalid type, must be one of image, link, redirect, html, json")
+}
+
+// Function for serving cached images according to ServeMode of request (only link and json support multiple images)
+func serveImages(w http.ResponseWriter, r *http.Request, request ImageRequest, filenames []string) {
+	addRecentImages(filenames)
+	if request.Client != "" {
+		addClientImages(request.Client, filenames)
+	}
+
+	// Add metadata headers of first image
+	info := getImageInfo(filenames[0])
+	markImagesServed(filenames)
+	w.Header().Set("X-Image-ID", info.ID)
+	w.Header().Set("X-Dominant-Color", info.DominantColor)
+	w.Header().Set("X-BlurHash", info.BlurHash)
+
+	imageLink := getCachedImageLink(request.BaseURL, filenames[0])
+	if request.ServeMode == ServeModeLink {
+		// Serve image links, one per line
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for i, filename := range filenames {
+			if i > 0 {
+				fmt.Fprint(w, "\n")
+			}
+			fmt.Fprint(w, getCachedImageLink(request.BaseURL, filename))
+		}
+	} else if request.ServeMode == ServeModeRedirect {
+		// Serve image via 302 redirect
+		http.Redirect(w, r, imageLink, http.StatusFound)
+	} else if request.ServeMode == ServeModeHtml {
+		// Serve image as html page
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := imagePageTemplate.Execute(w, imageLink); err != nil {
+			getLogger(r.Context()).Error("Failed to render image page", "error", err)
+		}
+	} else if request.ServeMode == ServeModeJson {
+		// Serve image links with metadata as json, a list if count was requested
+		var responses []ImageResponse
+		for _, filename := range filenames {
+			info := getImageInfo(filename)
+			responses = append(responses, ImageResponse{
+				ID:            info.ID,
+				URL:           getCachedImageLink(request.BaseURL, filename),
+				Width:         info.Width,
+				Height:        info.Height,
+				Size:          info.Size,
+				Format:        info.Format,
+				CachedAt:      info.CachedAt,
+				DominantColor: info.DominantColor,
+				BlurHash:      info.BlurHash,
+			})
+		}
+		if request.List {
+			writeJSON(w, http.StatusOK, responses)
+		} else {
+			writeJSON(w, http.StatusOK, responses[0])
+		}
+	} else {
+		// Serve image bytes directly
+		http.ServeFile(w, r, getCachedPath(filenames[0]))
+	}
+}
+
+// Function for checking if a remote may be used, remotes in cooldown are admitted again for a probe once it expires
+func isRemoteHealthy(remote Remote) bool {
+	remoteHealthLock.Lock()
+	defer remoteHealthLock.Unlock()
+	health, ok := remoteHealth[remote.URL]
+	return !ok || !time.Now().Before(health.UnhealthyUntil)
+}
+
+// Function for recording a failed retrieval from a remote, putting it in cooldown after too many consecutive failures
+func recordRemoteFailure(remote Remote, err error) {
+	config := getActiveConfig()
+	remoteHealthLock.Lock()
+	defer remoteHealthLock.Unlock()
+	health, ok := remoteHealth[remote.URL]
+	if !ok {
+		health = &RemoteHealth{URL: remote.URL}
+		remoteHealth[remote.URL] = health
+	}
+	health.ConsecutiveFailures++
+	health.Failures++
+	health.LastFailure = time.Now()
+	health.LastError = err.Error()
+	if health.ConsecutiveFailures >= config.RemoteFailureThreshold {
+		health.UnhealthyUntil = time.Now().Add(time.Duration(config.RemoteCooldownMin) * time.Minute)
+		slog.Warn("Remote failed too many times in a row, skipping it", "remote", remote.URL, "failures", health.ConsecutiveFailures, "until", health.UnhealthyUntil, "error", err)
+	}
+}
+
+// Function for recording a successful retrieval from a remote
+func recordRemoteSuccess(remote Remote) {
+	remoteHealthLock.Lock()
+	defer remoteHealthLock.Unlock()
+	health, ok := remoteHealth[remote.URL]
+	if !ok {
+		health = &RemoteHealth{URL: remote.URL}
+		remoteHealth[remote.URL] = health
+	}
+	health.ConsecutiveFailures = 0
+	health.Successes++
+	health.LastSuccess = time.Now()
+	health.UnhealthyUntil = time.Time{}
+}
+
+// Function for resetting success and failure counts of all remotes
+func resetRemoteCounters() {
+	remoteHealthLock.Lock()
+	defer remoteHealthLock.Unlock()
+	for _, health := range remoteHealth {
+		health.Successes = 0
+		health.Failures = 0
+	}
+}
+
+// Function for getting total size of cached files in bytes
+func getCachedBytes(filenames []string) int64 {
+	var size int64
+	for _, filename := range filenames {
+		if fileInfo, err := os.Stat(getCachedPath(filename)); err == nil {
+			size += fileInfo.Size()
+		}
+	}
+	return size
+}
+
+// Function for serving html dashboard with config, cache occupancy, remote health and recent errors
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Dashboard reveals config and remotes, so only admins can see it
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filenames, err := getCachedFilenames("")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		getLogger(r.Context()).Error("Failed to list cache folder", "error", err)
+	}
+	status := StatusPage{
+		Version:        getVersionString(),
+		StartedAt:      startTime,
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+		Mode:           config.Mode,
+		EffectiveMode:  getEffectiveMode(),
+		CachedImages:   countCachedImages(filenames),
+		MaxCacheSize:   getMaxCacheCount(),
+		CacheSize:      getHumanSize(getCachedBytes(filenames)),
+		MaxCacheSizeMB: config.MaxCacheSizeMB,
+		Errors:         getRecentErrors(),
+		Config:         getConfigString(*config),
+		RefreshSeconds: StatusRefreshSeconds,
+	}
+	for _, remote := range getRemotes() {
+		health := getRemoteHealth(remote)
+		if health.LastSuccess.After(status.LastRemoteFetch) {
+			status.LastRemoteFetch = health.LastSuccess
+		}
+		status.Remotes = append(status.Remotes, health)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := statusTemplate.Execute(w, status); err != nil {
+		getLogger(r.Context()).Error("Failed to render status page", "error", err)
+	}
+}
+
+// Function for serving cache and traffic statistics as json, counters are reset afterwards if reset query parameter is 1
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Statistics reveal remotes and traffic, so only admins can see them
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := StatsResponse{
+		Mode:             config.Mode,
+		EffectiveMode:    getEffectiveMode(),
+		ServedFromCache:  servedFromCache.Load(),
+		RemoteFetches:    remoteFetches.Load(),
+		InFlightRequests: inFlightRequests.Load(),
+		QueuedRequests:   queuedRequests.Load(),
+		RejectedRequests: rejectedRequests.Load(),
+		Remotes:          []RemoteHealth{},
+		StartedAt:        startTime,
+		UptimeSeconds:    int64(time.Since(startTime).Seconds()),
+	}
+	filenames, err := getCachedFilenames("")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		getLogger(r.Context()).Error("Failed to list cache folder", "error", err)
+	}
+	stats.CachedImages = countCachedImages(filenames)
+	stats.CachedFiles = len(filenames)
+	stats.CacheBytes = getCachedBytes(filenames)
+	for _, remote := range getRemotes() {
+		health := getRemoteHealth(remote)
+		if health.LastSuccess.After(stats.LastRemoteFetch) {
+			stats.LastRemoteFetch = health.LastSuccess
+		}
+		stats.Remotes = append(stats.Remotes, health)
+	}
+	if r.URL.Query().Get("reset") == "1" {
+		servedFromCache.Store(0)
+		remoteFetches.Store(0)
+		rejectedRequests.Store(0)
+		resetRemoteCounters()
+		slog.Info("Reset statistics counters")
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// Function for passing a line logged with the log package to slog handler, taking level from its Error or Warning prefix
+func (writer LogWriter) Write(data []byte) (int, error) {
+	message := strings.TrimSpace(string(data))
+	level := slog.LevelInfo
+	if strings.HasPrefix(message, "Error:") {
+		level = slog.LevelError
+		message = strings.TrimSpace(strings.TrimPrefix(message, "Error:"))
+	} else if strings.HasPrefix(message, "Warning:") {
+		level = slog.LevelWarn
+		message = strings.TrimSpace(strings.TrimPrefix(message, "Warning:"))
+	}
+	if !writer.Handler.Enabled(context.Background(), level) {
+		return len(data), nil
+	}
+	record := slog.NewRecord(time.Now(), level, message, 0)
+	if err := writer.Handler.Handle(context.Background(), record); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Function for logging config with secrets redacted, as a structured field in JSON mode
+func logConfig(message string, config Config) {
+	configString := getConfigString(config)
+	buf := bytes.Buffer{}
+	if config.LogFormat == LogFormatJSON && json.Compact(&buf, []byte(configString)) == nil {
+		slog.Info(message, "config", json.RawMessage(buf.Bytes()))
+		return
+	}
+	log.Println(message+": \n", configString)
+}
+
+// Function for parsing name of log level, one of debug, info, warn, error
+func getLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	switch strings.ToLower(name) {
+	case "debug", "info", "warn", "error":
+		err := level.UnmarshalText([]byte(name))
+		return level, err
+	}
+	return level, errors.New("Unknown log level " + name)
+}
+
+// Function for applying LogLevel of config to all loggers
+func setLogLevel(config Config) {
+	level, err := getLogLevel(config.LogLevel)
+	if err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+}
+
+// Function for opening filename for appending, rotating it once it exceeds LogMaxSizeMB
+func openRotatingFile(filename string, config Config) (*RotatingFile, error) {
+	file := &RotatingFile{
+		FileName:   filename,
+		MaxSize:    int64(config.LogMaxSizeMB) * 1024 * 1024,
+		MaxBackups: config.LogMaxBackups,
+		MaxAge:     time.Duration(config.LogMaxAgeDays) * 24 * time.Hour,
+	}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Function for opening file of rotating file and taking over its current size
+func (file *RotatingFile) open() error {
+	f, err := os.OpenFile(file.FileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.File = f
+	file.Size = info.Size()
+	return nil
+}
+
+// Function for writing data to rotating file, rotating it first if data would exceed its max size
+func (file *RotatingFile) Write(data []byte) (int, error) {
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+	if file.MaxSize > 0 && file.Size > 0 && file.Size+int64(len(data)) > file.MaxSize {
+		// Logging is unavailable here as it would write to this file, keep writing to old file on failure
+		if err := file.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: Failed to rotate", file.FileName+",", err)
+		}
+	}
+	if file.File == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := file.File.Write(data)
+	file.Size += int64(n)
+	return n, err
+}
+
+// Function for closing rotating file
+func (file *RotatingFile) Close() error {
+	file.Lock.Lock()
+	defer file.Lock.Unlock()
+	if file.File == nil {
+		return nil
+	}
+	err := file.File.Close()
+	file.File = nil
+	return err
+}
+
+// Function for renaming current file to a timestamped backup, reopening it and removing old backups, lock must be held
+func (file *RotatingFile) rotate() error {
+	if err := file.File.Close(); err != nil {
+		return err
+	}
+	backupName := file.FileName + "." + time.Now().Format(LogBackupTimeFormat)
+	renameErr := os.Rename(file.FileName, backupName)
+	// Reopen even if renaming failed, so logging continues
+	if err := file.open(); err != nil {
+		file.File = nil
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	file.removeOldBackups()
+	return nil
+}
+
+// Function for removing backups of rotating file beyond MaxBackups or older than MaxAge
+func (file *RotatingFile) removeOldBackups() {
+	matches, err := filepath.Glob(file.FileName + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		// Only touch files named by rotation
+		if _, err := time.Parse(LogBackupTimeFormat, strings.TrimPrefix(match, file.FileName+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// Newest first, timestamps sort lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, backup := range backups {
+		remove := file.MaxBackups > 0 && i >= file.MaxBackups
+		if !remove && file.MaxAge > 0 {
+			info, err := os.Stat(backup)
+			remove = err == nil && time.Since(info.ModTime()) > file.MaxAge
+		}
+		if remove {
+			if err := os.Remove(backup); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+		}
+	}
+}
+
+// Function for setting up logging to output, lines of the log package go through the same level filter as slog and become JSON events in JSON mode
+func setupLogging(output io.Writer, format string) {
+	var handler slog.Handler
+	if format == LogFormatJSON {
+		handler = slog.NewJSONHandler(output, &slog.HandlerOptions{Level: &logLevel})
+	} else {
+		handler = &TextLogHandler{Output: output, Lock: &sync.Mutex{}}
+	}
+	// Errors are kept for /status as well
+	handler = RecentErrorsHandler{Handler: handler}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+	log.SetOutput(LogWriter{Handler: handler})
+}
+
+// Function for remembering error records in recent errors before passing records on
+func (handler RecentErrorsHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError {
+		buf := bytes.Buffer{}
+		buf.WriteString(record.Message)
+		record.Attrs(func(attr slog.Attr) bool {
+			writeLogAttr(&buf, "", attr)
+			return true
+		})
+		addRecentError(RecentError{Time: record.Time, Message: buf.String()})
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+// Function for getting copy of recent errors handler with attrs added to every record
+func (handler RecentErrorsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return RecentErrorsHandler{Handler: handler.Handler.WithAttrs(attrs)}
+}
+
+// Function for getting copy of recent errors handler with following attributes grouped by name
+func (handler RecentErrorsHandler) WithGroup(name string) slog.Handler {
+	return RecentErrorsHandler{Handler: handler.Handler.WithGroup(name)}
+}
+
+// Function for adding error to ring buffer of recent errors, overwriting the oldest one once MaxRecentErrors are kept
+func addRecentError(recentError RecentError) {
+	recentErrorsLock.Lock()
+	defer recentErrorsLock.Unlock()
+	if len(recentErrors) < MaxRecentErrors {
+		recentErrors = append(recentErrors, recentError)
+		return
+	}
+	recentErrors[recentErrorsNext] = recentError
+	recentErrorsNext = (recentErrorsNext + 1) % MaxRecentErrors
+}
+
+// Function for getting recent errors, newest first
+func getRecentErrors() []RecentError {
+	recentErrorsLock.Lock()
+	defer recentErrorsLock.Unlock()
+	recent := make([]RecentError, 0, len(recentErrors))
+	for i := len(recentErrors) - 1; i >= 0; i-- {
+		recent = append(recent, recentErrors[(recentErrorsNext+i)%len(recentErrors)])
+	}
+	return recent
+}
+
+// Function for checking whether text log handler logs records of level
+func (handler *TextLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+// Function for writing record as a line in the format of the log package, with level prefix and attributes appended as key=value
+func (handler *TextLogHandler) Handle(_ context.Context, record slog.Record) error {
+	buf := bytes.Buffer{}
+	recordTime := record.Time
+	if recordTime.IsZero() {
+		recordTime = time.Now()
+	}
+	buf.WriteString(recordTime.Format("2006/01/02 15:04:05 "))
+	switch {
+	case record.Level >= slog.LevelError:
+		buf.WriteString("Error: ")
+	case record.Level >= slog.LevelWarn:
+		buf.WriteString("Warning: ")
+	case record.Level < slog.LevelInfo:
+		buf.WriteString("Debug: ")
+	}
+	buf.WriteString(record.Message)
+	for _, attr := range handler.Attrs {
+		writeLogAttr(&buf, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeLogAttr(&buf, handler.Group, attr)
+		return true
+	})
+	buf.WriteByte('\n')
+	handler.Lock.Lock()
+	defer handler.Lock.Unlock()
+	_, err := handler.Output.Write(buf.Bytes())
+	return err
+}
+
+// Function for getting copy of text log handler with attrs added to every record
+func (handler *TextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	newHandler := *handler
+	newHandler.Attrs = append([]slog.Attr{}, handler.Attrs...)
+	for _, attr := range attrs {
+		attr.Key = handler.Group + attr.Key
+		newHandler.Attrs = append(newHandler.Attrs, attr)
+	}
+	return &newHandler
+}
+
+// Function for getting copy of text log handler with keys of following attributes prefixed by group name
+func (handler *TextLogHandler) WithGroup(name string) slog.Handler {
+	newHandler := *handler
+	if name != "" {
+		newHandler.Group = handler.Group + name + "."
+	}
+	return &newHandler
+}
+
+// Function for writing attribute as key=value to buf, flattening groups
+func writeLogAttr(buf *bytes.Buffer, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			writeLogAttr(buf, prefix, groupAttr)
+		}
+		return
+	}
+	fmt.Fprintf(buf, " %s%s=%v", prefix, attr.Key, attr.Value.Any())
+}
+
+// Function for checking whether ip is one of TrustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	config := getActiveConfig()
+	for _, proxy := range config.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if net.ParseIP(proxy).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for checking whether request was sent by a trusted proxy, connections over unix socket come from a local reverse proxy
+func isFromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return true
+	}
+	return isTrustedProxy(net.ParseIP(host))
+}
+
+// Function for getting IP address of client, taken from X-Forwarded-For when the request came through trusted proxies
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Connections over unix socket come from a local reverse proxy
+		host = ""
+	} else if !isTrustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	// Walk X-Forwarded-For from the nearest hop, the first address not of a trusted proxy is the client
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	if host == "" {
+		return "-"
+	}
+	return host
+}
+
+// Function for recording status code of a response
+func (recorder *StatusRecorder) WriteHeader(statusCode int) {
+	if recorder.Status == 0 {
+		recorder.Status = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Function for counting bytes of a response body
+func (recorder *StatusRecorder) Write(data []byte) (int, error) {
+	if recorder.Status == 0 {
+		recorder.Status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.Bytes += int64(n)
+	return n, err
+}
+
+// Function for giving http.ResponseController access to the wrapped response
+func (recorder *StatusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// Function for getting ID of request from its X-Request-ID header if it is sane, otherwise a new random one
+func getRequestID(r *http.Request) string {
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID != "" && len(requestID) <= MaxRequestIDLength && regexp.MustCompile(`^[A-Za-z0-9._:-]+$`).MatchString(requestID) {
+		return requestID
+	}
+	return fmt.Sprintf("%08x", randomIntn(math.MaxInt32))
+}
+
+// Function for wrapping handler to give every request an ID, echoed in response header and attached to all lines logged with its logger
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := getRequestID(r)
+		w.Header().Set(RequestIDHeader, requestID)
+		logger := slog.Default().With("request_id", requestID)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, logger)))
+	})
+}
+
+// Function for getting logger carried by ctx, or default logger if there is none
+func getLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Function for getting context carrying only the logger of ctx, for work outliving the request
+func getLoggerContext(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), loggerContextKey{}, getLogger(ctx))
+}
+
+// Function for wrapping handler to write an entry to access log for every request, health checks are not logged
+func logAccess(handler http.Handler, accessLog *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		config := getActiveConfig()
+		if r.URL.Path == config.PathPrefix+"/healthz" {
+			return
+		}
+		// Browsers keep asking for missing favicons, which is not worth logging
+		if r.URL.Path == config.PathPrefix+"/favicon.ico" && recorder.Status == http.StatusNotFound {
+			return
+		}
+		if recorder.Status == 0 {
+			recorder.Status = http.StatusOK
+		}
+		entry := AccessLogEntry{
+			Time:       start,
+			ClientIP:   getClientIP(r),
+			Method:     r.Method,
+			Path:       getRedactedRequestURI(r),
+			Protocol:   r.Proto,
+			Status:     recorder.Status,
+			Bytes:      recorder.Bytes,
+			DurationMs: time.Since(start).Milliseconds(),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  w.Header().Get(RequestIDHeader),
+		}
+		if config.AccessLogFormat == AccessLogFormatJSON {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				getLogger(r.Context()).Error("Failed to encode access log entry", "error", err)
+				return
+			}
+			accessLog.Println(string(line))
+			return
+		}
+		// Combined log format, with duration in milliseconds appended
+		referer := entry.Referer
+		if referer == "" {
+			referer = "-"
+		}
+		accessLog.Printf("%s - - [%s] %q %d %d %q %q %d\n", entry.ClientIP, entry.Time.Format("02/Jan/2006:15:04:05 -0700"), entry.Method+" "+entry.Path+" "+entry.Protocol, entry.Status, entry.Bytes, referer, entry.UserAgent, entry.DurationMs)
+	})
+}
+
+// Function for checking whether cache folder is writable by creating and removing a file in its tmp folder
+func isCacheWritable() bool {
+	config := getActiveConfig()
+	folder := getCachedPath(config.CacheTmpFolder)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return false
+	}
+	filename := getCachedPath(config.CacheTmpFolder + "/" + getTmpName() + ".healthz")
+	if err := ioutil.WriteFile(filename, nil, 0644); err != nil {
+		return false
+	}
+	return os.Remove(filename) == nil
+}
+
+// Function for checking whether the last retrieval from any remote succeeded, remotes are never contacted for this
+func hasReachableRemote() bool {
+	for _, remote := range getRemotes() {
+		health := getRemoteHealth(remote)
+		if !health.LastSuccess.IsZero() && health.LastSuccess.After(health.LastFailure) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for getting version and build information
+func getVersionInfo() VersionInfo {
+	info := VersionInfo{Version: Version, Commit: BuildCommit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = setting.Value
+			} else if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// Function for getting version and build information as one line of text
+func getVersionString() string {
+	info := getVersionInfo()
+	versionString := "ImgAPICacher-Go " + info.Version
+	if info.Commit != "" {
+		versionString += " (commit " + info.Commit + ")"
+	}
+	if info.BuildDate != "" {
+		versionString += " built " + info.BuildDate
+	}
+	return versionString + " with " + info.GoVersion
+}
+
+// Function for serving version and build information as json
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, getVersionInfo())
+}
+
+// Function for serving health of the service for load balancers, also requiring a reachable remote or cached image if deep query parameter is 1
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	checks := map[string]bool{
+		"config":         getActiveConfig() != nil,
+		"cache_writable": isCacheWritable(),
+	}
+	if r.URL.Query().Get("deep") == "1" {
+		count, err := getCachedImageCount()
+		checks["remote_or_image"] = hasReachableRemote() || (err == nil && count > 0)
+	}
+	response := HealthResponse{Status: "ok", Checks: checks}
+	statusCode := http.StatusOK
+	for _, ok := range checks {
+		if !ok {
+			response.Status = "unhealthy"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, statusCode, response)
+}
+
+// Function for serving health of all remotes as json
+func serveRemoteStatus(w http.ResponseWriter, r *http.Request) {
+	// Remote URLs and errors may carry credentials, so only admins can see them
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	statuses := []RemoteHealth{}
+	for _, remote := range getRemotes() {
+		statuses = append(statuses, getRemoteHealth(remote))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// Function for getting copy of health of remote
+func getRemoteHealth(remote Remote) RemoteHealth {
+	remoteHealthLock.Lock()
+	defer remoteHealthLock.Unlock()
+	status := RemoteHealth{URL: remote.URL}
+	if health, ok := remoteHealth[remote.URL]; ok {
+		status = *health
+	}
+	status.Healthy = !time.Now().Before(status.UnhealthyUntil)
+	return status
+}
+
+// Function for checking whether update interval of remote has passed since it was last fetched
+func isRemoteDue(remote Remote) bool {
+	remoteNextFetchLock.Lock()
+	defer remoteNextFetchLock.Unlock()
+	return !time.Now().Before(remoteNextFetch[remote.URL])
+}
+
+// Function for checking whether any remote of category (any if empty) that would be used for fetching is due
+func hasDueRemote(category string) bool {
+	remotes, _ := getUsableRemotes(category)
+	for _, remote := range remotes {
+		if isRemoteDue(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for getting remotes of category (any if empty) to fetch from, skipping unhealthy ones unless none is healthy, returns them with whether they are healthy
+func getUsableRemotes(category string) ([]Remote, bool) {
+	var remotes, healthyRemotes, weightedRemotes []Remote
+	for _, remote := range getRemotes() {
+		if category != "" && remote.Category != category {
+			continue
+		}
+		remotes = append(remotes, remote)
+		if isRemoteHealthy(remote) {
+			healthyRemotes = append(healthyRemotes, remote)
+			if remote.Weight > 0 {
+				weightedRemotes = append(weightedRemotes, remote)
+			}
+		}
+	}
+	// Remotes of weight 0 are only used once all others are unhealthy
+	if len(weightedRemotes) > 0 {
+		return weightedRemotes, true
+	}
+	if len(healthyRemotes) > 0 {
+		return healthyRemotes, true
+	}
+	return remotes, false
+}
+
+// Function for setting earliest next fetch of remote to its UpdateInterval (or UpdateInterval in config) from now
+func scheduleNextFetch(remote Remote) {
+	config := getActiveConfig()
+	interval := remote.UpdateInterval
+	if interval == 0 {
+		interval = config.UpdateInterval
+	}
+	remoteNextFetchLock.Lock()
+	defer remoteNextFetchLock.Unlock()
+	remoteNextFetch[remote.URL] = time.Now().Add(time.Duration(interval) * time.Second)
+}
+
+// Function for getting remotes in config, the returned slice is never modified in place
+func getRemotes() []Remote {
+	return getActiveConfig().Remotes
+}
+
+// Function for checking whether admin endpoints can tell local clients apart, which is not the case behind a reverse proxy on unix socket or TrustedProxies
+func hasLocalAdminAccess() bool {
+	config := getActiveConfig()
+	return config.ListenSocket == "" && len(config.TrustedProxies) == 0
+}
+
+// Function for checking whether request comes directly from loopback address, requests forwarded by a reverse proxy on the same host are not local
+func isLocalRequest(r *http.Request) bool {
+	if !hasLocalAdminAccess() {
+		return false
+	}
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-Ip"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Function for checking whether request may use admin endpoints, which requires AdminToken if set and a local client otherwise, writes error response if not
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	config := getActiveConfig()
+	if config.AdminToken == "" {
+		if !isLocalRequest(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if !hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ImgAPICacher"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Function for checking whether request carries AdminToken in Authorization header or token query parameter
+func hasAdminToken(r *http.Request) bool {
+	config := getActiveConfig()
+	if config.AdminToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// Function for wrapping handler to require BasicAuthUser and BasicAuthPassword if set, requests with AdminToken are let through as well
+func requireBasicAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := getActiveConfig()
+		if config.BasicAuthUser == "" || (*config.BasicAuthExemptHealth && r.URL.Path == config.PathPrefix+"/healthz") || hasAdminToken(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// Compare hashes so neither content nor length of credentials leaks through timing
+		user, password, _ := r.BasicAuth()
+		userHash := sha256.Sum256([]byte(user))
+		passwordHash := sha256.Sum256([]byte(password))
+		expectedUserHash := sha256.Sum256([]byte(config.BasicAuthUser))
+		expectedPasswordHash := sha256.Sum256([]byte(config.BasicAuthPassword))
+		userMatch := subtle.ConstantTimeCompare(userHash[:], expectedUserHash[:])
+		passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:])
+		if userMatch&passwordMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ImgAPICacher", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Function for getting URI of request for logging, with value of token query parameter redacted
+func getRedactedRequestURI(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get("token") == "" {
+		return r.URL.RequestURI()
+	}
+	query.Set("token", "REDACTED")
+	redactedURL := *r.URL
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.RequestURI()
+}
+
+// Function for listing, adding and removing remotes at runtime, changes are persisted to config file
+func serveRemotes(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Remotes may carry credentials, so only admins can manage them
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		remotes := []RemoteInfo{}
+		for _, remote := range getRemotes() {
+			remotes = append(remotes, RemoteInfo{Remote: getRedactedRemote(remote), Health: getRemoteHealth(remote)})
+		}
+		writeJSON(w, http.StatusOK, remotes)
+	case "POST":
+		var remote Remote
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&remote); err != nil {
+			http.Error(w, "Invalid remote, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		remote, err := normalizeRemote(remote, config.CacheTmpFolder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Probe remote like ValidateRemotesOnStart does before accepting it
+		if _, err := getRemoteImgURLs(remote); err != nil {
+			http.Error(w, "Remote validation failed, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = updateConfig(func(config *Config) error {
+			for _, existing := range config.Remotes {
+				if existing.URL == remote.URL {
+					return errors.New("Remote already exists")
+				}
+			}
+			remotes := make([]Remote, len(config.Remotes), len(config.Remotes)+1)
+			copy(remotes, config.Remotes)
+			config.Remotes = append(remotes, remote)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		slog.Info("Added remote", "remote", remote.URL)
+		writeJSON(w, http.StatusCreated, RemoteInfo{Remote: getRedactedRemote(remote), Health: getRemoteHealth(remote)})
+	case "DELETE":
+		remoteURL := r.URL.Query().Get("url")
+		err := updateConfig(func(config *Config) error {
+			remotes := []Remote{}
+			for _, remote := range config.Remotes {
+				if remote.URL != remoteURL {
+					remotes = append(remotes, remote)
+				}
+			}
+			if len(remotes) == len(config.Remotes) {
+				return errors.New("Remote not found")
+			}
+			config.Remotes = remotes
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		remoteHealthLock.Lock()
+		delete(remoteHealth, remoteURL)
+		remoteHealthLock.Unlock()
+		remoteNextFetchLock.Lock()
+		delete(remoteNextFetch, remoteURL)
+		remoteNextFetchLock.Unlock()
+		slog.Info("Removed remote", "remote", remoteURL)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Function for ordering remotes randomly, earlier positions more likely for higher weights and remotes of weight 0 last
+func getWeightedOrder(remotes []Remote) []Remote {
+	var ordered, zeroWeight, remaining []Remote
+	totalWeight := 0.0
+	for _, remote := range remotes {
+		if remote.Weight > 0 {
+			remaining = append(remaining, remote)
+			totalWeight += remote.Weight
+		} else {
+			zeroWeight = append(zeroWeight, remote)
+		}
+	}
+	// Repeatedly draw a remote proportional to its weight without replacement
+	for len(remaining) > 0 {
+		target := randomFloat64() * totalWeight
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			target -= remaining[i].Weight
+			if target < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, remaining[i])
+		totalWeight -= remaining[i].Weight
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	for _, i := range randomPerm(len(zeroWeight)) {
+		ordered = append(ordered, zeroWeight[i])
+	}
+	return ordered
+}
+
+// Function for fetching an image from remotes of category (any if empty) into cache folder, returns cached filename or empty string on failure
+func cacheRemoteImage(ctx context.Context, quality int, category string) string {
+	logger := getLogger(ctx)
+	remotes, healthy := getUsableRemotes(category)
+	if len(remotes) == 0 {
+		logger.Error("No remote found for category", "category", category)
+		return ""
+	}
+	if !healthy {
+		logger.Warn("All remotes are unhealthy, trying them anyway")
+	}
+	// Remotes still within their update interval are skipped in favor of due ones
+	var dueRemotes []Remote
+	for _, remote := range remotes {
+		if isRemoteDue(remote) {
+			dueRemotes = append(dueRemotes, remote)
+		}
+	}
+	if len(dueRemotes) > 0 {
+		remotes = dueRemotes
+	}
+
+	// Try each remote at most once in weighted random order, so load still spreads when all are working
+	for _, remote := range getWeightedOrder(remotes) {
+		filename := cacheImageFromRemote(ctx, remote, quality)
+		if filename != "" {
+			return filename
+		}
+	}
+	logger.Error("All remotes failed to provide an image", "remotes", len(remotes))
+	return ""
+}
+
+// Function for requesting remote and extracting image URLs from its response
+func getRemoteImgURLs(remote Remote) ([]string, error) {
+	// Send get request to remote
+	response, err := requestRemote(apiClient.Load(), remote.Method, remote.URL, remote.Body, remote)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// Validate response status code, redirects are accepted if they tell where to go
+	isRedirect := response.StatusCode >= 300 && response.StatusCode < 400 && response.Header.Get("Location") != ""
+	if response.StatusCode != 200 && !isRedirect {
+		return nil, errors.New("Invalid response status code " + strconv.Itoa(response.StatusCode))
+	}
+
+	// Get response content type and decide whether to extract image URLs from response body
+	contentType := response.Header.Get("Content-Type")
+	if isRedirect {
+		// Redirect target is the image URL, relative locations are resolved later
+		return []string{response.Header.Get("Location")}, nil
+	} else if getExtension(contentType) != "" {
+		// Content type is an image, then we should directly download from this URL
+		return []string{remote.URL}, nil
+	}
+
+	// Extract image URLs from response body
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	var imgURLs []string
+	if remote.Selector != "" {
+		imgURLs, err = getJSONStrings(body, remote.Selector)
+		if err != nil {
+			return nil, errors.New("Selector " + remote.Selector + " of remote " + remote.URL + " failed, " + err.Error())
+		}
+	} else {
+		imgURLs = getImgURLs(string(body))
+		if dataURI := getDataURI(string(body)); len(imgURLs) == 0 && dataURI != "" {
+			imgURLs = []string{dataURI}
+		}
+		if relativeURL := getRelativeImgURL(string(body)); len(imgURLs) == 0 && relativeURL != "" {
+			imgURLs = []string{relativeURL}
+		}
+	}
+	if len(imgURLs) == 0 {
+		return nil, errors.New("No image URL found in response of remote " + remote.URL)
+	}
+	return imgURLs, nil
+}
+
+// Function for probing every remote in config concurrently and logging a summary, returns number of remotes that passed
+func validateRemotes() int {
+	remotes := getRemotes()
+	slog.Info("Validating remotes", "remotes", len(remotes))
+	results := make([]error, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func(i int, remote Remote) {
+			defer wg.Done()
+			_, results[i] = getRemoteImgURLs(remote)
+		}(i, remote)
+	}
+	wg.Wait()
+	passed := 0
+	for i, remote := range remotes {
+		if results[i] != nil {
+			slog.Warn("Remote validation FAIL", "remote", remote.URL, "error", results[i])
+		} else {
+			slog.Info("Remote validation PASS", "remote", remote.URL)
+			passed++
+		}
+	}
+	slog.Info("Remote validation finished", "passed", passed, "remotes", len(remotes))
+	return passed
+}
+
+// Function for getting folder slug of remote from its host and port
+func getRemoteSlug(remote Remote) string {
+	config := getActiveConfig()
+	slug := "remote"
+	if remoteURL, err := url.Parse(remote.URL); err == nil && remoteURL.Host != "" {
+		slug = regexp.MustCompile(`[^a-z0-9.-]+`).ReplaceAllString(strings.ToLower(remoteURL.Host), "_")
+		slug = strings.Trim(slug, "._")
+	}
+	// Slug must never point to tmp folder or outside of cache folder
+	if slug == "" || slug == config.CacheTmpFolder {
+		slug = "remote_" + slug
+	}
+	return slug
+}
+
+// Function for getting folder of remote relative to cache folder, using "/" as separator
+func getRemoteFolder(remote Remote) string {
+	if remote.Category != "" {
+		return remote.Category + "/" + getRemoteSlug(remote)
+	}
+	return getRemoteSlug(remote)
+}
+
+// Function for fetching images from given remote into cache folder, returns first cached filename or empty string on failure
+func cacheImageFromRemote(ctx context.Context, remote Remote, quality int) string {
+	logger := getLogger(ctx)
+	config := getActiveConfig()
+	logger.Info("Retrieving remote", "remote", remote.URL)
+
+	imgURLs, err := getRemoteImgURLs(remote)
+	if err != nil {
+		logger.Error("Failed to retrieve remote", "remote", remote.URL, "error", err)
+		recordRemoteFailure(remote, err)
+		return ""
+	}
+
+	// Limit number of images to MaxImagesPerResponse and remaining space in cache
+	limit := config.MaxImagesPerResponse
+	if maxCount := getMaxCacheCount(); maxCount != 0 {
+		count, err := getCachedImageCount()
+		if err == nil && maxCount-count < limit {
+			limit = int(math.Max(1, float64(maxCount-count)))
+		}
+	}
+	if len(imgURLs) > limit {
+		imgURLs = imgURLs[:limit]
+	}
+
+	// Images are stored in subfolder of remote, inside category subfolder for categorized remotes
+	folder := getRemoteFolder(remote)
+	if err := createCacheFolders(ctx, folder); err != nil {
+		logger.Error("Failed to create cache folders", "remote", remote.URL, "error", err)
+		return ""
+	}
+
+	// Cache every image, one bad image doesn't abort the others
+	var cached string
+	var lastErr error
+	for _, imgURL := range imgURLs {
+		filename, err := cacheImageSource(ctx, remote, imgURL, folder, quality)
+		switch {
+		case errors.Is(err, ErrDuplicateImage), errors.Is(err, ErrNearDuplicateImage):
+			// Remote provided a good image that is already cached
+			err = nil
+		case errors.Is(err, ErrBelowMinResolution), errors.Is(err, ErrCacheWriteFailed):
+			filename, err = "", nil
+		}
+		if err != nil {
+			logger.Error("Failed to cache image", "remote", remote.URL, "url", imgURL, "error", err)
+			lastErr = err
+		} else if cached == "" {
+			cached = filename
+		}
+	}
+	if cached == "" {
+		if lastErr != nil {
+			recordRemoteFailure(remote, lastErr)
+		}
+		return ""
+	}
+	recordRemoteSuccess(remote)
+	// Only successful fetches delay the next one, so failures can be retried right away
+	scheduleNextFetch(remote)
+
+	// Refresh effective mode right away, as cache may have become full
+	if config.SwitchToLocalWhenFull {
+		if _, err := getCachedImageCount(); err != nil {
+			logger.Error("Failed to count cached images", "error", err)
+		}
+	}
+	return cached
+}
+
+// Function for creating cache folder, its tmp folder and folder relative to cache folder if they don't exist
+func createCacheFolders(ctx context.Context, folder string) error {
+	config := getActiveConfig()
+	logger := getLogger(ctx)
+	if _, err := os.Stat(config.CacheFolder); os.IsNotExist(err) {
+		logger.Debug("Creating cache folder", "folder", config.CacheFolder)
+		if err = os.Mkdir(config.CacheFolder, 0755); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(getCachedPath(config.CacheTmpFolder)); os.IsNotExist(err) {
+		// Tmp folder holds uncompressed images
+		logger.Debug("Creating tmp folder", "folder", getCachedPath(config.CacheTmpFolder))
+		if err = os.Mkdir(getCachedPath(config.CacheTmpFolder), 0755); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(getCachedPath(folder), 0755)
+}
+
+// Function for downloading or decoding one image returned by remote and caching it in folder relative to cache folder, returns cached filename or error as cacheImageData does
+func cacheImageSource(ctx context.Context, remote Remote, imgURL string, folder string, quality int) (string, error) {
+	logger := getLogger(ctx)
+	config := getActiveConfig()
+	// Decode image data embedded in response instead of downloading it
+	var imgData []byte
+	var err error
+	extension := getImgExtension(imgURL)
+	if strings.HasPrefix(imgURL, "data:") || remote.Base64 {
+		imgData, extension, err = decodeImageData(imgURL)
+		if err != nil {
+			return "", errors.New("Failed to decode image data from remote " + remote.URL + ", " + err.Error())
+		}
+		imgURL = remote.URL
+	} else {
+		// Relative and protocol-relative URLs are resolved against remote URL
+		imgURL = resolveImgURL(remote.URL, imgURL)
+		// Remotes can be added at runtime, so URL of remote itself is checked as well
+		if err := checkImgURL(imgURL); err != nil {
+			logger.Warn("Refused image URL", "remote", remote.URL, "url", imgURL, "error", err)
+			return "", nil
+		}
+		logger.Debug("Retrieving from URL", "remote", remote.URL, "url", imgURL)
+	}
+
+	// Filename for uncompressed image
+	filenameUncompressed := getCachedPath(config.CacheTmpFolder + "/" + getTmpName() + "." + extension)
+	if extension == "" {
+		// URLs from selectors may have no extension, image type is detected from content later
+		filenameUncompressed = strings.TrimSuffix(filenameUncompressed, ".")
+	}
+
+	// Uncompressed image is removed from tmp folder however caching ends
+	defer func() {
+		if err := os.Remove(filenameUncompressed); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Failed to remove uncompressed image", "filename", filenameUncompressed, "error", err)
+		}
+	}()
+
+	// Download image to tmp folder, or write decoded image data there
+	if imgData != nil {
+		logger.Debug("Writing decoded image", "remote", remote.URL, "filename", filenameUncompressed)
+		err = ioutil.WriteFile(filenameUncompressed, imgData, 0644)
+		if err != nil {
+			logger.Error("Failed to write decoded image", "filename", filenameUncompressed, "error", err)
+			return "", nil
+		}
+	} else {
+		logger.Debug("Downloading image", "url", imgURL, "filename", filenameUncompressed)
+		err = downloadFile(ctx, filenameUncompressed, imgURL, remote)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Read and compress image, downloaded and decoded data alike must look like a supported image
+	data, err := ioutil.ReadFile(filenameUncompressed)
+	if err != nil {
+		logger.Error("Failed to read uncompressed image", "filename", filenameUncompressed, "error", err)
+		return "", nil
+	}
+	return cacheImageData(ctx, data, remote, imgURL, folder, quality)
+}
+
+// Function for validating, compressing and deduplicating image data from remote or upload and caching it in folder relative to cache folder, returns cached filename, which is the existing one for duplicates along with ErrDuplicateImage or ErrNearDuplicateImage
+func cacheImageData(ctx context.Context, data []byte, remote Remote, imgURL string, folder string, quality int) (string, error) {
+	config := getActiveConfig()
+	logger := getLogger(ctx)
+	if _, err := sniffImage(data); err != nil {
+		return "", errors.New("Data of " + imgURL + " is not an image, " + err.Error())
+	}
+	// Reject images below minimum resolution
+	if config.MinWidth > 0 || config.MinHeight > 0 {
+		imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err == nil && (imgConfig.Width < config.MinWidth || imgConfig.Height < config.MinHeight) {
+			logger.Info("Rejected image below minimum resolution", "url", imgURL, "width", imgConfig.Width, "height", imgConfig.Height)
+			return "", ErrBelowMinResolution
+		}
+	}
+	// Save compressed image to cache folder
+	data, err := compressImage(ctx, data, quality)
+	if err != nil {
+		logger.Warn("Failed to compress image", "url", imgURL, "error", err)
+		// Only cache the original bytes if they are a decodable image, a valid header alone may come with truncated data
+		if _, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return "", errors.New("Downloaded file is not a valid image (" + err.Error() + ") from URL: " + imgURL)
+		}
+	}
+	if *config.StripMetadata {
+		// Make sure no metadata leaks even if compression was skipped
+		data, err = stripMetadata(data)
+		if err != nil {
+			logger.Warn("Failed to strip metadata", "url", imgURL, "error", err)
+		}
+	}
+	// Reuse cached image with identical content, possibly returned by another remote
+	hash := sha256.Sum256(data)
+	if filename, ok := getImageByHash(hex.EncodeToString(hash[:])); ok {
+		logger.Info("Dedup hit, image with identical content already cached", "url", imgURL, "filename", filename)
+		return filename, ErrDuplicateImage
+	}
+	// Reuse cached image that looks the same, e.g. the same picture at another compression level
+	if config.NearDuplicateThreshold > 0 {
+		if imgSrc, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+			if filename, distance, ok := findNearDuplicate(getPerceptualHash(imgSrc), quality, config.NearDuplicateThreshold); ok {
+				logger.Info("Near-duplicate of cached image", "url", imgURL, "filename", filename, "distance", distance)
+				return filename, ErrNearDuplicateImage
+			}
+		}
+	}
+	// Filename is derived from content, and encodes quality if it differs from default
+	filename := folder + "/" + hex.EncodeToString(hash[:])[:CacheFilenameHashLength] + getQualitySuffix(quality) + ".jpg"
+	filenameCompressed := getCachedPath(filename)
+	logger.Debug("Compressing image", "url", imgURL, "filename", filenameCompressed)
+	evictForImage(int64(len(data)))
+	err = writeFileAtomic(filenameCompressed, data)
+	if err != nil {
+		logger.Error("Failed to write image", "filename", filenameCompressed, "error", err)
+		return "", ErrCacheWriteFailed
+	}
+	addCachedFile(filename)
+	// Analyze new image while its data is still in memory
+	indexImage(filename, data, time.Now())
+	setImageSource(filename, remote.URL, imgURL)
+	return filename, nil
+}
+
+// Function for taking a remote retrieval slot, waiting at most wait for one to become free, returns whether it was taken
+func acquireRetrievalSlot(wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case retrievalSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Function for freeing a remote retrieval slot taken by acquireRetrievalSlot
+func releaseRetrievalSlot() {
+	<-retrievalSlots
+}
+
+// Function for fetching an image from remotes of category with a retrieval slot, concurrent callers with same category and quality share one fetch, returns cached filename and whether a slot was free
+func cacheRemoteImageShared(ctx context.Context, quality int, category string, wait time.Duration) (string, bool) {
+	logger := getLogger(ctx)
+	key := "fetch/" + category + "/" + strconv.Itoa(quality)
+	retrievalCallsLock.Lock()
+	if call, ok := retrievalCalls[key]; ok {
+		// Another caller is fetching already, wait for its result
+		retrievalCallsLock.Unlock()
+		logger.Debug("Waiting for remote retrieval in progress", "category", category, "quality", quality)
+		<-call.Done
+		return call.Filename, call.Acquired
+	}
+	call := &RetrievalCall{Done: make(chan struct{})}
+	retrievalCalls[key] = call
+	retrievalCallsLock.Unlock()
+
+	call.Acquired = acquireRetrievalSlot(wait)
+	if call.Acquired {
+		call.Filename = cacheRemoteImage(ctx, quality, category)
+		releaseRetrievalSlot()
+	}
+	retrievalCallsLock.Lock()
+	delete(retrievalCalls, key)
+	retrievalCallsLock.Unlock()
+	close(call.Done)
+	return call.Filename, call.Acquired
 }
 
-// Function for retrieving image from remotes
-func retrieveRemote(hostname string, served bool, w http.ResponseWriter, r *http.Request) {
+// Function for retrieving image from remotes into cache without serving it, returns cached filename or empty string if nothing was cached
+func fetchRemoteImage(ctx context.Context, request ImageRequest, waiting bool) (string, error) {
+	logger := getLogger(ctx)
+	config := getActiveConfig()
+	// Waiting clients share one retrieval and wait up to RemoteTimeoutSec, background updates are skipped if other retrievals are already running
+	fetch := func() (string, bool) {
+		if waiting {
+			return cacheRemoteImageShared(ctx, request.Quality, request.Category, time.Duration(config.RemoteTimeoutSec)*time.Second)
+		}
+		if !acquireRetrievalSlot(time.Duration(RetrievalWaitMillis) * time.Millisecond) {
+			return "", false
+		}
+		defer releaseRetrievalSlot()
+		return cacheRemoteImage(ctx, request.Quality, request.Category), true
+	}
+
 	// Start retrieving process
-	log.Println("--- Starting Remote Retrieval ---")
-	// Update last update timestamp
-	timestamp = time.Now().Unix()
+	logger.Debug("--- Starting Remote Retrieval ---")
+	defer logger.Debug("--- Finished Remote Retrieval ---")
+
+	// Fetch image, retrying until it matches requested orientation if the client is waiting for it
+	filename, ok := fetch()
+	for retries := 0; ok && waiting && filename != "" && !matchesOrientation(getImageInfo(filename), request.Orientation); retries++ {
+		if retries >= MaxOrientationRetries {
+			logger.Error("No image matching orientation retrieved", "orientation", request.Orientation, "retries", retries)
+			return "", ErrNoMatchingOrientation
+		}
+		logger.Info("Retrieved image does not match orientation, retrying", "filename", filename, "orientation", request.Orientation)
+		filename, ok = fetch()
+	}
+	if !ok {
+		logger.Warn("Too many remote retrievals in progress, skipping retrieval")
+		return "", ErrRetrievalsBusy
+	}
+	if filename == "" {
+		return "", ErrAllRemotesFailed
+	}
+	return filename, nil
+}
+
+// Function for retrieving image from remotes for a waiting client and serving it
+func retrieveRemote(request ImageRequest, w http.ResponseWriter, r *http.Request) {
+	filename, err := fetchRemoteImage(r.Context(), request, true)
+	switch {
+	case errors.Is(err, ErrRetrievalsBusy):
+		// Cache had nothing to serve and the retrieval slots are taken, client should come back soon
+		w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfterSeconds))
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, ErrNoMatchingOrientation):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrAllRemotesFailed):
+		writeError(w, r, http.StatusBadGateway, err.Error())
+	default:
+		serveImages(w, r, request, []string{filename})
+	}
+}
+
+/* Main functions */
+
+// Global varable for storing template of html page showing one image, escaping its link
+var imagePageTemplate = template.Must(template.New("image").Parse(`<html><head><title>ImgAPICacher</title></head><body style="margin: 0px; background-color: black; "><img style="display: block; margin-left: auto; margin-right: auto; height: 100%;" src="{{.}}" /></body></html>`))
+
+// Global varable for storing template of gallery page
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ImgAPICacher Gallery</title>
+<style>
+body { font-family: sans-serif; margin: 1em; background: #f4f4f4; }
+.images { display: flex; flex-wrap: wrap; gap: 1em; }
+.image { background: white; padding: 0.5em; width: 240px; font-size: 0.8em; word-break: break-all; }
+.image img { width: 240px; display: block; }
+.image form { margin-top: 0.5em; }
+</style></head><body>
+<h1>Gallery</h1>
+<p>{{.Total}} images, page {{.Page}} of {{.Pages}}</p>
+<div class="images">
+{{range .Images}}<div class="image">
+<a href="{{.ImageURL}}"><img src="{{.ThumbnailURL}}" loading="lazy" alt="{{.Filename}}"></a>
+<div>{{.Filename}}</div><div>{{.Size}}, cached {{.Age}} ago</div>
+<form method="post" action="{{$.FormAction}}"><input type="hidden" name="filename" value="{{.Filename}}"><button type="submit">Delete</button></form>
+</div>
+{{end}}</div>
+<p>{{if .PrevURL}}<a href="{{.PrevURL}}">Previous</a> {{end}}{{if .NextURL}}<a href="{{.NextURL}}">Next</a>{{end}}</p>
+</body></html>
+`))
+
+// Global varable for storing template of status page
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="{{.RefreshSeconds}}"><title>ImgAPICacher Status</title>
+<style>
+body { font-family: sans-serif; margin: 1em; background: #f4f4f4; }
+table { border-collapse: collapse; background: white; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; font-size: 0.9em; }
+.healthy { color: #2a7d2a; }
+.unhealthy { color: #b22; }
+pre { background: white; padding: 0.5em; overflow: auto; }
+</style></head><body>
+<h1>Status</h1>
+<table>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Started</th><td>{{.StartedAt.Format "2006-01-02 15:04:05"}} ({{.Uptime}} ago)</td></tr>
+<tr><th>Mode</th><td>{{.Mode}}{{if ne .Mode .EffectiveMode}} (effective: {{.EffectiveMode}}){{end}}</td></tr>
+<tr><th>Cached images</th><td>{{.CachedImages}}{{if .MaxCacheSize}} of {{.MaxCacheSize}}{{end}}</td></tr>
+<tr><th>Cache size</th><td>{{.CacheSize}}{{if .MaxCacheSizeMB}} of {{.MaxCacheSizeMB}} MB{{end}}</td></tr>
+<tr><th>Last remote fetch</th><td>{{if .LastRemoteFetch.IsZero}}never{{else}}{{.LastRemoteFetch.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+</table>
+<h2>Remotes</h2>
+<table>
+<tr><th>URL</th><th>Health</th><th>Successes</th><th>Failures</th><th>Last success</th><th>Last error</th></tr>
+{{range .Remotes}}<tr><td>{{.URL}}</td><td>{{if .Healthy}}<span class="healthy">healthy</span>{{else}}<span class="unhealthy">unhealthy</span>{{end}}</td><td>{{.Successes}}</td><td>{{.Failures}}</td><td>{{if .LastSuccess.IsZero}}never{{else}}{{.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<h2>Config</h2>
+<pre>{{.Config}}</pre>
+</body></html>
+`))
+
+// Global varable for storing recent errors for /status, a ring buffer of MaxRecentErrors with next to overwrite at recentErrorsNext
+var recentErrors []RecentError
+var recentErrorsNext int
+var recentErrorsLock sync.Mutex
+
+// Global varable for storing built-in favicon, served if FaviconFile is not set
+//
+//go:embed favicon.ico
+var defaultFavicon []byte
+
+// Global varable for storing config in use, replaced as a whole on every change
+var activeConfig atomic.Pointer[Config]
+var configUpdateLock sync.Mutex
+
+// Global varable for storing slot of decoding an image larger than LargeImagePixels
+var largeImageSlot = make(chan struct{}, 1)
 
-	// Get a random remote from config.Remotes
-	remote := config.Remotes[rand.Intn(len(config.Remotes))]
-	log.Println("Retrieving remote: ", remote)
+// Global varable for storing slots of concurrent remote retrievals, sized by MaxConcurrentRetrievals at startup
+var retrievalSlots chan struct{}
+
+// Global varable for storing slots of concurrently handled requests, sized by MaxConcurrentRequests and replaced on reload, nil if unlimited
+var requestSlots atomic.Pointer[chan struct{}]
+
+// Global varable for storing number of requests being handled, waiting for a slot and rejected for lack of one
+var inFlightRequests atomic.Int64
+var queuedRequests atomic.Int64
+var rejectedRequests atomic.Int64
+
+// Global varable for storing errors of remote retrievals
+var ErrRetrievalsBusy = errors.New("Too many remote retrievals in progress")
+var ErrNoMatchingOrientation = errors.New("No image matching orientation found")
+var ErrAllRemotesFailed = errors.New("all remotes failed")
+
+// Global varable for storing reasons of images not being cached that are no fault of their source
+var ErrDuplicateImage = errors.New("Image with identical content already cached")
+var ErrNearDuplicateImage = errors.New("Near-duplicate of cached image")
+var ErrBelowMinResolution = errors.New("Image below minimum resolution")
+var ErrCacheWriteFailed = errors.New("Failed to write image to cache")
+
+// Global varable for storing remote retrievals in progress that concurrent callers can share, keyed by category and quality
+var retrievalCalls = map[string]*RetrievalCall{}
+var retrievalCallsLock sync.Mutex
+
+// Global varable for storing earliest next fetch time of remotes, keyed by remote URL
+var remoteNextFetch = map[string]time.Time{}
+var remoteNextFetchLock sync.Mutex
+
+// Global varable for storing random source shared by all random picks, seeded once at startup
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+var randomLock sync.Mutex
+
+// Global varable for storing HTTP clients used for remotes
+var httpClient atomic.Pointer[http.Client]
+var apiClient atomic.Pointer[http.Client]
+
+// Global varable for storing health of remotes, keyed by remote URL
+var remoteHealth = map[string]*RemoteHealth{}
+var remoteHealthLock sync.Mutex
+
+// Global varable for storing build information, set with -ldflags "-X main.BuildCommit=... -X main.BuildDate=..." or taken from version control info of the build
+var BuildCommit string
+var BuildDate string
+
+// Global varable for storing traffic counters and start time of process for statistics
+var servedFromCache atomic.Int64
+var remoteFetches atomic.Int64
+var startTime = time.Now()
+
+// Global varable for storing metadata of cached images, keyed by filename in cache folder
+var imageIndex ImageIndex
+
+// Global varable for storing in-memory listing of cache folder, with whether each file is a valid image
+var cachedFiles map[string]bool
+var cachedFilesTime time.Time
+var cachedFilesLock sync.Mutex
+
+// Global varable for storing lock making evictions for MaxCacheSizeMB one at a time
+var evictionLock sync.Mutex
+
+// Global varable for storing minimum level of logged messages, changes with LogLevel on reload
+var logLevel slog.LevelVar
+
+// Global varable for storing whether cache became full and effective mode switched to local, never persisted to config
+var switchedToLocal atomic.Bool
+
+// Global varable for storing counter making names of tmp files unique
+var tmpNameCounter atomic.Uint64
+
+// Global varable for storing files in tmp folder being written by writeFileAtomic
+var tmpFilesInUse = map[string]bool{}
+var tmpFilesInUseLock sync.Mutex
+
+// Global varable for storing recently served images to avoid repeating them
+var recentImages []string
+var recentImagesLock sync.Mutex
+
+// Global varable for storing rate limit token buckets, keyed by client IP
+var rateLimitBuckets = map[string]*TokenBucket{}
+var rateLimitBucketsLock sync.Mutex
+
+// Global varable for storing images served to each client, keyed by client key
+var clientHistories = map[string]*ClientHistory{}
+var clientHistoriesLock sync.Mutex
+
+// Global varable for storing loaded TLS certificate and modification time of its files
+var tlsCertificate *tls.Certificate
+var tlsCertificateModTime time.Time
+var tlsCertificateLock sync.Mutex
+
+// Function for setting CORS headers if request origin is allowed, returns whether it is allowed
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	config := getActiveConfig()
+	origin := r.Header.Get("Origin")
+	if containsString(config.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	// Response differs per origin, so shared caches must key on it
+	w.Header().Add("Vary", "Origin")
+	if origin != "" && containsString(config.AllowedOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		return true
+	}
+	return false
+}
+
+// Function for setting caching headers on responses of cached images, which never change once cached
+func setImageCacheHeaders(w http.ResponseWriter) {
+	config := getActiveConfig()
+	if config.CacheControlMaxAge == 0 {
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(config.CacheControlMaxAge))
+	w.Header().Set("Expires", time.Now().Add(time.Duration(config.CacheControlMaxAge)*time.Second).UTC().Format(http.TimeFormat))
+}
+
+// Function for getting TLS certificate, loading it again whenever certificate or key file changes (e.g. renewed by certbot)
+func getTLSCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	config := getActiveConfig()
+	var modTime time.Time
+	for _, filename := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if fileInfo, err := os.Stat(filename); err == nil && fileInfo.ModTime().After(modTime) {
+			modTime = fileInfo.ModTime()
+		}
+	}
+	tlsCertificateLock.Lock()
+	defer tlsCertificateLock.Unlock()
+	if tlsCertificate != nil && !modTime.After(tlsCertificateModTime) {
+		return tlsCertificate, nil
+	}
+	// Files changed, only try once per change so a half-written renewal doesn't reload on every handshake
+	tlsCertificateModTime = modTime
+	certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		if tlsCertificate == nil {
+			return nil, err
+		}
+		slog.Warn("Failed to reload TLS certificate, keeping previous one", "file", config.TLSCertFile, "error", err)
+		return tlsCertificate, nil
+	}
+	slog.Info("Loaded TLS certificate", "file", config.TLSCertFile)
+	tlsCertificate = &certificate
+	return tlsCertificate, nil
+}
+
+// Function for creating ACME manager obtaining and renewing certificates of ACMEDomains, stored in ACMECacheFolder
+func newACMEManager() *autocert.Manager {
+	config := getActiveConfig()
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Cache:      autocert.DirCache(config.ACMECacheFolder),
+		Email:      config.ACMEEmail,
+	}
+}
+
+// Function for handle general HTTP request
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Admins can delete images in cache folder
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/"+config.CacheFolder+"/") {
+		serveDelete(w, r)
+		return
+	}
+
+	// Make sure only accept GET, HEAD and OPTIONS requests
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Set CORS headers
+	allowed := setCORSHeaders(w, r)
+
+	// Answer CORS preflight requests
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// If requesting robots.txt, return configured or default one
+	if r.URL.Path == "/robots.txt" {
+		serveRobots(w, r)
+		return
+	}
+
+	// If requesting favicon.ico, return configured or built-in icon
+	if r.URL.Path == "/favicon.ico" {
+		serveFavicon(w, r)
+		return
+	}
+
+	// If requesting image by ID, return that image
+	if strings.HasPrefix(r.URL.Path, "/img/") {
+		filename, ok := getImageByID(r.URL.Path[len("/img/"):])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		cachedFile, ok := getCachedImageFile(filename)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fileInfo, err := os.Stat(cachedFile)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				forgetCachedImage(filename)
+			}
+			http.NotFound(w, r)
+			return
+		}
+		info := getCurrentImageInfo(filename, fileInfo)
+		w.Header().Set("X-Image-ID", info.ID)
+		w.Header().Set("X-BlurHash", info.BlurHash)
+		setImageCacheHeaders(w)
+		setContentDisposition(w, r, filename, info)
+		// ServeFile answers If-None-Match with 304 based on this ETag
+		if info.Hash != "" {
+			w.Header().Set("ETag", `"`+info.Hash+`"`)
+		}
+		http.ServeFile(w, r, cachedFile)
+		return
+	}
+
+	// If requesting metadata of a cached image, return it as json
+	if strings.HasPrefix(r.URL.Path, "/cache-info/") {
+		serveCacheInfo(w, r, r.URL.Path[len("/cache-info/"):])
+		return
+	}
+
+	// If requesting image in cache folder, return that image
+	if strings.HasPrefix(r.URL.Path, "/"+config.CacheFolder+"/") {
+		// Make sure the requesting filename is of one of supported extensions
+		if getImgExtension(r.URL.Path) == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Get image from cache folder, rejecting paths that leave the cached image folders, also through symlinks
+		relativeName := r.URL.Path[len(config.CacheFolder)+2:]
+		filename, ok := getCachedImageFile(relativeName)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if fileInfo, err := os.Stat(filename); err == nil && !fileInfo.IsDir() {
+			// Image exists, add its BlurHash and ETag from content hash
+			var info ImageInfo
+			if !isResizedImage(filename) {
+				info = getCurrentImageInfo(relativeName, fileInfo)
+				w.Header().Set("X-BlurHash", info.BlurHash)
+			}
+			width, height := getResizeParams(r)
+			if info.Hash != "" {
+				// ServeFile answers If-None-Match with 304 based on this ETag
+				etag := info.Hash
+				if width > 0 || height > 0 {
+					etag += "-" + strconv.Itoa(width) + "x" + strconv.Itoa(height)
+				}
+				w.Header().Set("ETag", `"`+etag+`"`)
+			}
+			// Resize image if requested
+			if width > 0 || height > 0 {
+				filename, err = getResizedImage(filename, width, height)
+				if err != nil {
+					getLogger(r.Context()).Error("Failed to resize image", "filename", filename, "error", err)
+					http.Error(w, "Failed to resize image", http.StatusInternalServerError)
+					return
+				}
+			}
+			// Return image
+			setImageCacheHeaders(w)
+			setContentDisposition(w, r, filename, info)
+			http.ServeFile(w, r, filename)
+			return
+		} else {
+			// Image doesn't exist, return 404
+			if errors.Is(err, os.ErrNotExist) && !isResizedImage(filename) && isValidCachedFile(relativeName) {
+				forgetCachedImage(relativeName)
+			}
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// All other request paths except / are discarded
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Responses of root endpoint change per request and must not be cached
+	if config.CacheControlMaxAge != 0 {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	// Get request parameters
+	request, err := getImageRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Unknown categories are reported together with valid ones
+	if request.Category != "" && !containsString(getCategories(), request.Category) {
+		message := "Unknown category, valid categories: " + strings.Join(getCategories(), ", ")
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "Unknown category", "categories": getCategories()})
+		} else {
+			http.Error(w, message, http.StatusNotFound)
+		}
+		return
+	}
+
+	// Try to serve images from cache
+	served := false
+	// Get random images from in-memory listing of local folder
+	filenames := pickCachedImages(request)
+	// Image bytes are served directly, so pick again if the file is gone
+	for attempt := 1; request.ServeMode == ServeModeFile && len(filenames) > 0 && attempt < MaxPickAttempts; attempt++ {
+		if _, err := os.Stat(getCachedPath(filenames[0])); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		forgetCachedImage(filenames[0])
+		filenames = pickCachedImages(request)
+	}
+	if len(filenames) > 0 {
+		serveImages(w, r, request, filenames)
+		getLogger(r.Context()).Debug("Serving local images", "filenames", filenames)
+		servedFromCache.Add(1)
+		served = true
+	}
 
-	// Send get request to remote
-	response, err := http.Get(remote)
-	if err != nil {
-		log.Println("Error:", err)
+	// HEAD requests only report on cached images and never access remote
+	if r.Method == "HEAD" {
+		if !served {
+			writeError(w, r, http.StatusServiceUnavailable, "No image found in cache")
+		}
 		return
 	}
-	defer response.Body.Close()
 
-	// Validate response status code
-	if response.StatusCode != 200 && response.StatusCode != 302 && response.StatusCode != 301 {
-		log.Println("Error:", errors.New("Invalid response status code "+strconv.Itoa(response.StatusCode)))
+	// Determine whether to access remote to retrieve more images
+	if served && (getEffectiveMode() == ModeLocal || !hasDueRemote(request.Category)) {
 		return
+	} else {
+		if served {
+			// If we've served an image from local, but it's time to update, update in background without touching the response
+			remoteFetches.Add(1)
+			go fetchRemoteImage(getLoggerContext(r.Context()), request, false)
+		} else {
+			// If we didn't serve image from local, retrieve from remote
+			remoteFetches.Add(1)
+			retrieveRemote(request, w, r)
+		}
 	}
+}
 
-	// Get response content type and decide whether to extract image URL from response body
-	var imgURL string
-	contentType := response.Header.Get("Content-Type")
-	extension := getExtension(contentType)
-	if extension != "" {
-		// Content type is an image, then we should directly download from this URL
-		imgURL = remote
-	} else {
-		// Extract image URL from response body
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Println("Error:", err)
+// Function for fetching images from remotes every UpdateInterval regardless of requests, until ctx is done
+func prefetchImages(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(time.Duration(getActiveConfig().UpdateInterval) * time.Second):
+		}
+		// Config may have been reloaded or changed while waiting
+		config := getActiveConfig()
+		// Without a cache limit prefetching would never stop until the disk is full
+		if !*config.BackgroundPrefetch || (config.MaxCacheSize == 0 && config.MaxCacheSizeMB == 0) {
+			continue
+		}
+		// Pause while cache is full, resuming once images are removed, which also refreshes effective mode
+		if isCacheFull(0) {
+			continue
 		}
-		imgURL = getImgURL(string(body))
-		extension = getImgExtension(imgURL)
+		if getEffectiveMode() != ModeRemote || !hasDueRemote("") {
+			continue
+		}
+		if !acquireRetrievalSlot(time.Duration(RetrievalWaitMillis) * time.Millisecond) {
+			continue
+		}
+		slog.Debug("--- Starting Background Prefetch ---")
+		cacheRemoteImage(ctx, 0, "")
+		slog.Debug("--- Finished Background Prefetch ---")
+		releaseRetrievalSlot()
 	}
-	log.Println("Retrieving from URL: ", imgURL)
+}
 
-	// Filename for uncompressed image
-	filenameUncompressed := string(config.CacheFolder+string(os.PathSeparator)+config.CacheTmpFolder+string(os.PathSeparator)+strconv.FormatInt(time.Now().UnixNano(), 10)) + "." + extension
-	// Check if cache folder and its tmp folder exists
-	if _, err := os.Stat(config.CacheFolder); os.IsNotExist(err) {
-		// Create cache folder
-		log.Println("Creating cache folder: ", config.CacheFolder)
-		err = os.Mkdir(config.CacheFolder, 0755)
-		if err != nil {
-			log.Fatalln("Error:", err)
+// Function for checking whether number of cached images plus pending images reached MaxCacheSize
+func isCacheFull(pending int) bool {
+	maxCount := getMaxCacheCount()
+	if maxCount == 0 {
+		return false
+	}
+	count, err := getCachedImageCount()
+	return err == nil && count+pending >= maxCount
+}
+
+// Function for fetching count images from remotes with PrefetchConcurrency workers, stopping early when cache is full or ctx is done, progress is called with result so far after each image
+func prefetchImageBatch(ctx context.Context, count int, progress func(result PrefetchResult)) PrefetchResult {
+	config := getActiveConfig()
+	result := PrefetchResult{Requested: count}
+	var resultLock sync.Mutex
+	// Images being fetched by workers count towards MaxCacheSize
+	pending := 0
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < config.PrefetchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				resultLock.Lock()
+				if ctx.Err() != nil || isCacheFull(pending) {
+					result.Skipped++
+					progress(result)
+					resultLock.Unlock()
+					continue
+				}
+				pending++
+				resultLock.Unlock()
+				filename := ""
+				started := time.Now()
+				if acquireRetrievalSlot(time.Duration(config.RemoteTimeoutSec) * time.Second) {
+					filename = cacheRemoteImage(ctx, 0, "")
+					releaseRetrievalSlot()
+				}
+				resultLock.Lock()
+				pending--
+				if filename == "" {
+					result.Failed++
+				} else if getImageInfo(filename).CachedAt.Before(started) {
+					// Identical image was cached before and got reused
+					result.Duplicates++
+				} else {
+					result.Succeeded++
+				}
+				slog.Info("Prefetch progress", "done", result.Succeeded+result.Failed+result.Duplicates+result.Skipped, "total", count)
+				progress(result)
+				resultLock.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return result
+}
+
+// Function for handling requests listing near-duplicate clusters on GET and removing all but the kept image of each on DELETE
+func serveNearDuplicates(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Removing images is destructive, so only admins can use it
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	threshold := config.NearDuplicateThreshold
+	if threshold == 0 {
+		threshold = DefaultNearDuplicateThreshold
+	}
+	if r.URL.Query().Get("threshold") != "" {
+		var err error
+		threshold, err = strconv.Atoi(r.URL.Query().Get("threshold"))
+		if err != nil || threshold < 1 || threshold > PerceptualHashBits {
+			http.Error(w, "Invalid threshold, must be between 1 and "+strconv.Itoa(PerceptualHashBits), http.StatusBadRequest)
 			return
 		}
 	}
-	if _, err := os.Stat(config.CacheFolder + string(os.PathSeparator) + config.CacheTmpFolder); os.IsNotExist(err) {
-		// Create tmp folder for uncompressed images
-		log.Println("Creating tmp folder: ", config.CacheFolder+string(os.PathSeparator)+config.CacheTmpFolder)
-		err = os.Mkdir(config.CacheFolder+string(os.PathSeparator)+config.CacheTmpFolder, 0755)
-		if err != nil {
-			log.Fatalln("Error:", err)
-			return
+	clusters := getNearDuplicateClusters(threshold)
+	if r.Method == "DELETE" {
+		removed := 0
+		for _, cluster := range clusters {
+			for _, filename := range cluster.Duplicates {
+				if _, err := removeCachedImage(filename); err != nil {
+					getLogger(r.Context()).Error("Failed to remove near-duplicate image", "filename", filename, "error", err)
+					continue
+				}
+				slog.Info("Removed near-duplicate image", "filename", filename, "kept", cluster.Kept)
+				removed++
+			}
 		}
+		getLogger(r.Context()).Info("Removed near-duplicate images", "removed", removed, "clusters", len(clusters))
+		saveImageIndex()
 	}
+	writeJSON(w, http.StatusOK, clusters)
+}
 
-	// Download image to tmp folder
-	log.Println("Downloading image to: ", filenameUncompressed)
-	err = downloadFile(filenameUncompressed, imgURL)
-	if err != nil {
-		log.Println("Error:", err)
-		return
+// Function for getting size in bytes as human readable string
+func getHumanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
 	}
+	if unit == 0 {
+		return strconv.FormatInt(size, 10) + " " + units[unit]
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[unit]
+}
 
-	// Read and compress image
-	filenameCompressed := string(config.CacheFolder+string(os.PathSeparator)+strconv.FormatInt(time.Now().UnixNano(), 10)) + ".jpg"
-	log.Println("Compressing image to: ", filenameCompressed)
-	data, err := ioutil.ReadFile(filenameUncompressed)
-	if err != nil {
-		log.Println("Error:", err)
+// Function for getting URL of gallery page, keeping token query parameter so admins can navigate with it
+func getGalleryURL(r *http.Request, page int) string {
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+	if token := r.URL.Query().Get("token"); token != "" {
+		query.Set("token", token)
+	}
+	return "gallery?" + query.Encode()
+}
+
+// Function for serving paginated html gallery of cached images, newest first, deleting the image given by filename form value on POST
+func serveGallery(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	// Gallery allows deleting images, so only admins can use it
+	if !authorizeAdmin(w, r) {
 		return
 	}
-	// Save compressed image to cache folder
-	data, err = compressImage(data)
-	err = ioutil.WriteFile(filenameCompressed, data, 0644)
-	if err != nil {
-		log.Println("Error:", err)
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		// Forms of other sites must not be able to delete images
+		if !isSameOriginRequest(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		filename := r.PostFormValue("filename")
+		if getImgExtension(filename) == "" || !isCachedImagePath(filename) || isResizedImage(filename) {
+			http.Error(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
+		_, err := deleteCachedImage(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			getLogger(r.Context()).Error("Failed to delete cached image", "filename", filename, "error", err)
+			http.Error(w, "Failed to delete image", http.StatusInternalServerError)
+			return
+		}
+		getLogger(r.Context()).Info("Deleted image from gallery", "filename", filename)
+		http.Redirect(w, r, getGalleryURL(r, page), http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Remove uncompressed image from tmp folder
-	err = os.Remove(filenameUncompressed)
-	if err != nil {
-		log.Println("Error:", err)
-		return
-	} else {
-		log.Println("Removed uncompressed image: ", filenameUncompressed)
+	// Collect original images with their index info, resized variants are only thumbnails
+	filenames, err := getCachedFilenames("")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		getLogger(r.Context()).Error("Failed to list cache folder", "error", err)
+	}
+	var images []string
+	cachedAt := map[string]time.Time{}
+	for _, filename := range filenames {
+		if isResizedImage(filename) {
+			continue
+		}
+		images = append(images, filename)
+		if info, ok := imageIndex.Get(filename); ok {
+			cachedAt[filename] = info.CachedAt
+		}
 	}
+	sort.SliceStable(images, func(a, b int) bool {
+		return cachedAt[images[a]].After(cachedAt[images[b]])
+	})
 
-	// Check if current number of images have reached the MaxCacheSize limit
-	if config.MaxCacheSize != 0 {
-		files, err := ioutil.ReadDir(config.CacheFolder)
+	// Only images of requested page are looked at on disk
+	gallery := GalleryPage{Total: len(images), Page: page, Pages: (len(images) + GalleryPageSize - 1) / GalleryPageSize, FormAction: getGalleryURL(r, page)}
+	start := (page - 1) * GalleryPageSize
+	for i := start; i < len(images) && i < start+GalleryPageSize; i++ {
+		fileInfo, err := os.Stat(getCachedPath(images[i]))
 		if err != nil {
-			log.Println("Error:", err)
+			continue
+		}
+		info := getCurrentImageInfo(images[i], fileInfo)
+		// Gallery is next to cache folder, so relative links work behind any PathPrefix
+		imageURL := config.CacheFolder + "/" + images[i]
+		gallery.Images = append(gallery.Images, GalleryImage{
+			Filename:     images[i],
+			ImageURL:     imageURL,
+			ThumbnailURL: imageURL + "?w=" + strconv.Itoa(GalleryThumbnailWidth),
+			Size:         getHumanSize(fileInfo.Size()),
+			Age:          time.Since(info.CachedAt).Round(time.Second).String(),
+		})
+	}
+	if page > 1 {
+		gallery.PrevURL = getGalleryURL(r, page-1)
+	}
+	if page < gallery.Pages {
+		gallery.NextURL = getGalleryURL(r, page+1)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := galleryTemplate.Execute(w, gallery); err != nil {
+		getLogger(r.Context()).Error("Failed to render gallery page", "error", err)
+	}
+}
+
+// Function for prefetching number of images given by count query parameter, streaming progress as json lines ending with the summary
+func servePrefetch(w http.ResponseWriter, r *http.Request) {
+	// Prefetching causes load on remotes, so only admins can start it
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	count := DefaultPrefetchCount
+	if r.URL.Query().Get("count") != "" {
+		var err error
+		count, err = strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || count < 1 || count > MaxPrefetchCount {
+			http.Error(w, "Invalid count, must be between 1 and "+strconv.Itoa(MaxPrefetchCount), http.StatusBadRequest)
 			return
-		} else {
-			if len(files) >= config.MaxCacheSize {
-				// Limit MaxCacheSize reached, change mode to local
-				config.Mode = ModeLocal
-				writeConfig(config)
-				log.Println("Limit of MaxCacheSize (", config.MaxCacheSize, ") reached, switching mode to local")
-			}
-		}
-	}
-
-	// Serve image if not served yet
-	if !served {
-		// Serve image link according to ServeMode
-		if config.ServeMode == ServeModeLink {
-			// Serve image link
-			fmt.Fprintf(w, "http://%s/%s", hostname, strings.Replace(filenameCompressed, "\\", "/", -1))
-		} else if config.ServeMode == ServeModeRedirect {
-			// Serve image via 302 redirect
-			http.Redirect(w, r, "http://"+hostname+"/"+strings.Replace(filenameCompressed, "\\", "/", -1), 302)
-		} else if config.ServeMode == ServeModeHtml {
-			// Serve image as html page
-			fmt.Fprintf(w, "<html><head><title>ImgAPICacher</title></head><body style=\"margin: 0px; background-color: black; \"><img style=\"display: block; margin-left: auto; margin-right: auto; height: 100%%;\" src=\"http://%s/%s\" /></body></html>", hostname, strings.Replace(filenameCompressed, "\\", "/", -1))
-		} else {
-			// Serve image directly
-			http.ServeFile(w, r, filenameCompressed)
 		}
 	}
-	log.Println("--- Finished Remote Retrieval ---")
+	// Prefetching may take longer than WriteTimeoutSec, progress keeps the client informed meanwhile
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("Prefetch response may time out", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	getLogger(r.Context()).Info("--- Starting Prefetch ---", "count", count)
+	result := prefetchImageBatch(r.Context(), count, func(result PrefetchResult) {
+		// Client may have gone away, prefetch then stops through request context
+		if encoder.Encode(result) == nil {
+			controller.Flush()
+		}
+	})
+	getLogger(r.Context()).Info("--- Finished Prefetch ---", "count", count, "succeeded", result.Succeeded, "failed", result.Failed, "duplicates", result.Duplicates, "skipped", result.Skipped)
+	encoder.Encode(result)
 }
 
-/* Main functions */
+// Function for checking whether request was not sent by a page of another site, browsers send Origin with every POST and DELETE
+func isSameOriginRequest(r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		return true
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host == r.Host
+}
 
-// Global varable for storing config and timestamp (for recording last update time)
-var config Config
-var timestamp int64
+// Function for deleting a cached image given by path on DELETE of cache folder, or by filename or sha256 content hash on POST /delete
+func serveDelete(w http.ResponseWriter, r *http.Request) {
+	config := getActiveConfig()
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	// Pages of other sites open in an admin's browser must not be able to delete images
+	if !isSameOriginRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var filename string
+	switch r.Method {
+	case "DELETE":
+		if !strings.HasPrefix(r.URL.Path, "/"+config.CacheFolder+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		filename = r.URL.Path[len(config.CacheFolder)+2:]
+	case "POST":
+		filename = r.FormValue("filename")
+		if hash := strings.ToLower(r.FormValue("hash")); hash != "" {
+			var ok bool
+			filename, ok = getImageByHash(hash)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		if filename == "" {
+			http.Error(w, "Missing filename or hash", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	freed, err := deleteCachedImage(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		getLogger(r.Context()).Error("Failed to delete image", "filename", filename, "error", err)
+		http.Error(w, "Failed to delete image", http.StatusInternalServerError)
+		return
+	}
+	getLogger(r.Context()).Info("Deleted image", "filename", filename, "freed", freed)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-// Function for handle general HTTP request
-func handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Make sure only accept GET requests
-	if r.Method != "GET" {
+// Function for deleting all cached images, or those older than older_than, on POST /purge
+func servePurge(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	// Pages of other sites open in an admin's browser must not be able to wipe the cache
+	if !isSameOriginRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var result PurgeResult
+	var maxAge time.Duration
+	if r.URL.Query().Get("older_than") != "" {
+		var err error
+		maxAge, err = time.ParseDuration(r.URL.Query().Get("older_than"))
+		if err != nil || maxAge <= 0 {
+			http.Error(w, "Invalid older_than, must be a positive duration like 72h", http.StatusBadRequest)
+			return
+		}
+		result.OlderThan = maxAge.String()
+	}
+	var err error
+	result.Files, result.Bytes, err = purgeCache(maxAge)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfterSeconds))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	getLogger(r.Context()).Info("Purged cache", "files", result.Files, "bytes", result.Bytes, "older_than", result.OlderThan)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Function for caching images uploaded as multipart form files or fetched from URLs in JSON body, through the same pipeline as remote images
+func serveUpload(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	// Pages of other sites open in an admin's browser must not be able to inject images
+	if !isSameOriginRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	config := getActiveConfig()
+	ctx := r.Context()
+	baseURL, err := getRequestBaseURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Set CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Uploaded images are kept apart from retrieved ones, in category folder if given
+	category := r.URL.Query().Get("category")
+	if category != "" && !containsString(getCategories(), category) {
+		http.Error(w, "Unknown category, valid categories: "+strings.Join(getCategories(), ", "), http.StatusNotFound)
+		return
+	}
+	folder := UploadFolder
+	if category != "" {
+		folder = category + "/" + UploadFolder
+	}
+	if err := createCacheFolders(ctx, folder); err != nil {
+		getLogger(ctx).Error("Failed to create upload folder", "folder", folder, "error", err)
+		http.Error(w, "Failed to create cache folder", http.StatusInternalServerError)
+		return
+	}
 
-	// If requesting favicon.ico, return 404
-	if r.URL.Path == "/favicon.ico" {
-		http.NotFound(w, r)
+	// Uploads write to cache folder like retrievals, so purge must wait for them
+	if !acquireRetrievalSlot(time.Duration(config.RemoteTimeoutSec) * time.Second) {
+		w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfterSeconds))
+		http.Error(w, ErrRetrievalsBusy.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	defer releaseRetrievalSlot()
 
-	// If requesting image in cache folder, return that image
-	if strings.HasPrefix(r.URL.Path, "/"+config.CacheFolder+"/") {
-		// Make sure the requesting filename is of one of supported extensions
-		if getImgExtension(r.URL.Path) == "" {
-			http.NotFound(w, r)
+	// Whole request may hold MaxUploadFiles files of MaxDownloadSizeMB each
+	maxSize := int64(config.MaxDownloadSizeMB) * 1024 * 1024
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize*int64(MaxUploadFiles))
+	}
+	var results []UploadResult
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var request UploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON body, "+err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Get image from cache folder
-		filepath := config.CacheFolder + string(os.PathSeparator) + r.URL.Path[len(config.CacheFolder)+1:]
-		if _, err := os.Stat(filepath); err == nil {
-			// Image exists, return it
-			http.ServeFile(w, r, filepath)
+		if len(request.URLs) > MaxUploadFiles {
+			http.Error(w, "Too many URLs, at most "+strconv.Itoa(MaxUploadFiles)+" per request", http.StatusBadRequest)
 			return
-		} else {
-			// Image doesn't exist, return 404
-			http.NotFound(w, r)
+		}
+		for _, imgURL := range request.URLs {
+			result := UploadResult{Name: imgURL}
+			// URLs come from the client, so they are checked like URLs taken from remote responses
+			if err := checkImgURL(imgURL); err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			filename, err := cacheImageSource(ctx, Remote{URL: imgURL}, imgURL, folder, 0)
+			if err == nil && filename == "" {
+				err = errors.New("Failed to cache image")
+			}
+			results = append(results, getUploadResult(ctx, result, baseURL, filename, err))
+		}
+	} else {
+		if err := r.ParseMultipartForm(int64(UploadMemoryMB) * 1024 * 1024); err != nil {
+			http.Error(w, "Invalid multipart form, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		// Files are taken in order of form field names, so results are in a stable order
+		var fields []string
+		for field := range r.MultipartForm.File {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		var headers []*multipart.FileHeader
+		for _, field := range fields {
+			headers = append(headers, r.MultipartForm.File[field]...)
+		}
+		if len(headers) > MaxUploadFiles {
+			http.Error(w, "Too many files, at most "+strconv.Itoa(MaxUploadFiles)+" per request", http.StatusBadRequest)
 			return
 		}
+		for _, header := range headers {
+			result := UploadResult{Name: header.Filename}
+			if maxSize > 0 && header.Size > maxSize {
+				result.Error = "Size " + strconv.FormatInt(header.Size, 10) + " exceeds MaxDownloadSizeMB"
+				results = append(results, result)
+				continue
+			}
+			data, err := readUploadedFile(header)
+			if err != nil {
+				getLogger(ctx).Error("Failed to read uploaded file", "filename", header.Filename, "error", err)
+				result.Error = "Failed to read file"
+				results = append(results, result)
+				continue
+			}
+			filename, err := cacheImageData(ctx, data, Remote{}, header.Filename, folder, 0)
+			results = append(results, getUploadResult(ctx, result, baseURL, filename, err))
+		}
 	}
-
-	// All other request paths except / are discarded
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+	if len(results) == 0 {
+		http.Error(w, "No files or URLs to upload", http.StatusBadRequest)
 		return
 	}
+	if config.SwitchToLocalWhenFull {
+		if _, err := getCachedImageCount(); err != nil {
+			getLogger(ctx).Error("Failed to count cached images", "error", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
 
-	// Get hostname in request
-	hostname := r.Host
+// Function for reading a file of a multipart upload into memory
+func readUploadedFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
 
-	// Try to serve image from cache
-	served := false
-	// Get random image from local folder
-	files, err := ioutil.ReadDir(config.CacheFolder)
+// Function for filling upload result with link of cached image or caching error, duplicates are errors that still link the existing image
+func getUploadResult(ctx context.Context, result UploadResult, baseURL string, filename string, err error) UploadResult {
+	if filename != "" {
+		result.Filename = filename
+		result.URL = getCachedImageLink(baseURL, filename)
+	}
 	if err != nil {
-		log.Println("Error:", err)
-	} else {
-		if len(files) == 0 {
-			log.Println("Error:", "No image found in cache folder")
-		} else {
-			rand.Seed(time.Now().UnixNano())
-			fileIndex := rand.Intn(len(files))
-			// Make sure the file is an image
-			for !isImage(files[fileIndex].Name()) && len(files) > 0 {
-				// If the file is a directory, remove it from the list and get a new random file
-				if files[fileIndex].IsDir() {
-					files = append(files[:fileIndex], files[fileIndex+1:]...)
-					if len(files) == 0 {
-						break
-					}
-					fileIndex = rand.Intn(len(files))
-					continue
-				}
-				// Remove the non-image file
-				err = os.Remove(config.CacheFolder + string(os.PathSeparator) + files[fileIndex].Name())
-				if err != nil {
-					log.Println("Error:", err)
-				}
-				files = append(files[:fileIndex], files[fileIndex+1:]...)
-				if len(files) == 0 {
-					break
-				}
-				fileIndex = rand.Intn(len(files))
+		result.Error = err.Error()
+		if !errors.Is(err, ErrDuplicateImage) && !errors.Is(err, ErrNearDuplicateImage) {
+			getLogger(ctx).Warn("Failed to cache uploaded image", "name", result.Name, "error", err)
+		}
+	}
+	return result
+}
+
+// Function for removing stale tmp files and corrupt images every JanitorIntervalMinutes, until ctx is done
+func runJanitor(ctx context.Context) {
+	for {
+		// Check again every minute while disabled, so enabling it by reload takes effect
+		wait := time.Minute
+		if interval := getActiveConfig().JanitorIntervalMinutes; interval > 0 {
+			wait = time.Duration(interval) * time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if getActiveConfig().JanitorIntervalMinutes == 0 {
+			continue
+		}
+
+		// Tmp files of retrievals in progress are recent, so only old ones are removed
+		removed, removedSize := cleanTmpFolder(time.Duration(StaleTmpFileMinutes) * time.Minute)
+		// Images are validated again from disk, and removed once expired
+		corrupt := 0
+		expired := 0
+		invalidateCachedFiles()
+		filenames, err := getCachedFilenames("")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to list cache folder", "error", err)
+		}
+		for _, filename := range filenames {
+			if getImgExtension(filename) == "" {
+				continue
 			}
-			// If the file is still not an image, log error and retrieve from remote later
-			if len(files) == 0 || !isImage(files[fileIndex].Name()) {
-				// Log error
-				log.Println("Error:", "No image found in cache folder")
+			reason := ""
+			if !isImage(filename) {
+				reason = "corrupt"
+			} else if !isResizedImage(filename) && isExpiredImage(filename) {
+				reason = "expired"
 			} else {
-				// Serve image link according to ServeMode
-				if config.ServeMode == ServeModeLink {
-					// Serve image link
-					fmt.Fprintf(w, "http://%s/%s/%s", hostname, config.CacheFolder, files[fileIndex].Name())
-				} else if config.ServeMode == ServeModeRedirect {
-					// Serve image via 302 redirect
-					http.Redirect(w, r, "http://"+hostname+"/"+config.CacheFolder+"/"+files[fileIndex].Name(), 302)
-				} else if config.ServeMode == ServeModeHtml {
-					// Serve image directly as html page
-					fmt.Fprintf(w, "<html><head><title>ImgAPICacher</title></head><body style=\"margin: 0px; background-color: black; \"><img style=\"display: block; margin-left: auto; margin-right: auto; height: 100%%;\" src=\"http://%s/%s/%s\" /></body></html>", hostname, config.CacheFolder, files[fileIndex].Name())
-				} else {
-					// Serve image directly
-					http.ServeFile(w, r, config.CacheFolder+string(os.PathSeparator)+files[fileIndex].Name())
-				}
-				log.Println("Serving local image: ", files[fileIndex].Name())
-				served = true
+				continue
 			}
+			evictionLock.Lock()
+			freed, err := removeCachedImage(filename)
+			evictionLock.Unlock()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				slog.Error("Failed to remove image", "filename", filename, "reason", reason, "error", err)
+				continue
+			}
+			slog.Info("Janitor removed image", "filename", filename, "reason", reason)
+			if reason == "corrupt" {
+				corrupt++
+			} else {
+				expired++
+			}
+			removedSize += freed
 		}
+		duplicates, duplicatesSize := removeDuplicateImages()
+		removedSize += duplicatesSize
+		saveImageIndex()
+		slog.Info("Janitor finished", "stale_tmp_files", removed, "corrupt", corrupt, "expired", expired, "duplicates", duplicates, "reclaimed_bytes", removedSize)
 	}
+}
 
-	// Determine whether to access remote to retrieve more images
-	if served && (config.Mode == ModeLocal || time.Now().Unix()-timestamp < config.UpdateInterval) {
-		return
-	} else {
-		if served {
-			// If we've served an image from local, but it's time to update, update in background
-			go func() {
-				retrieveRemote(hostname, served, w, r)
-			}()
-		} else {
-			// If we didn't serve image from local, retrieve from remote
-			retrieveRemote(hostname, served, w, r)
+// Function for logging an error that prevents running and exiting
+func exitWithError(message string, args ...any) {
+	slog.Error(message, args...)
+	os.Exit(1)
+}
+
+// Function for listening on Unix socket in ListenSocket, replacing stale socket file, main removes it on shutdown
+func listenSocket() net.Listener {
+	config := getActiveConfig()
+	if fileInfo, err := os.Lstat(config.ListenSocket); err == nil {
+		if fileInfo.Mode()&os.ModeSocket == 0 {
+			exitWithError("ListenSocket exists and is not a socket", "socket", config.ListenSocket)
 		}
+		slog.Info("Removing stale socket", "socket", config.ListenSocket)
+		if err = os.Remove(config.ListenSocket); err != nil {
+			exitWithError("Failed to remove stale socket", "socket", config.ListenSocket, "error", err)
+		}
+	}
+	listener, err := net.Listen("unix", config.ListenSocket)
+	if err != nil {
+		exitWithError("Failed to listen on socket", "socket", config.ListenSocket, "error", err)
+	}
+	mode, _ := strconv.ParseUint(config.ListenSocketMode, 8, 32)
+	if err = os.Chmod(config.ListenSocket, os.FileMode(mode)); err != nil {
+		// Closing the listener removes the socket file
+		listener.Close()
+		exitWithError("Failed to set mode of socket", "socket", config.ListenSocket, "error", err)
+	}
+	return listener
+}
+
+// Function for creating HTTP server with timeouts from config, serving on default mux
+func newServer(address string, handler http.Handler) *http.Server {
+	config := getActiveConfig()
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadTimeoutSec) * time.Second,
+		ReadTimeout:       time.Duration(config.ReadTimeoutSec) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeoutSec) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeoutSec) * time.Second,
 	}
 }
 
 func main() {
-	// Create/Read config file
-	config = getConfig()
+	// Print version and exit if requested
+	printVersion := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(getVersionString())
+		return
+	}
+
+	// Create/Read config file, refusing to start with an invalid one
+	config, err := getConfig()
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	activeConfig.Store(&config)
 	// Initialize logging
 	var logOutput io.Writer
 	if config.LogFileName != "" {
-		logFile, err := os.OpenFile(config.LogFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		logFile, err := openRotatingFile(config.LogFileName, config)
 		if err != nil {
 			log.Fatalln("Error:", err)
 		}
@@ -565,15 +7347,172 @@ func main() {
 	} else {
 		logOutput = os.Stdout
 	}
-	log.SetOutput(logOutput)
-	log.Println("Initialized Config: \n", getConfigString(config))
+	setLogLevel(config)
+	setupLogging(logOutput, config.LogFormat)
+	slog.Info("Starting", "version", getVersionString())
+	logConfig("Initialized Config", config)
+	if config.AdminToken != "" {
+		log.Println("Admin endpoints require AdminToken")
+	} else if !hasLocalAdminAccess() {
+		log.Println("Warning: AdminToken is empty while ListenSocket or TrustedProxies is set, admin endpoints are disabled")
+	} else {
+		log.Println("AdminToken is empty, admin endpoints only accept direct requests from loopback addresses")
+	}
+
+	// Initialize HTTP client and slots of concurrent retrievals and requests
+	initHTTPClients()
+	retrievalSlots = make(chan struct{}, config.MaxConcurrentRetrievals)
+	setRequestSlots(config.MaxConcurrentRequests)
+
+	// Probe remotes, refusing to start without a working one if required
+	if config.ValidateRemotesOnStart && validateRemotes() == 0 && config.RequireValidRemote {
+		exitWithError("No remote passed validation")
+	}
+
+	// Remove files left in tmp folder by crashes and failed retrievals
+	removed, removedSize := cleanTmpFolder(time.Duration(StaleTmpFileMinutes) * time.Minute)
+	slog.Info("Removed stale files from tmp folder", "removed", removed, "bytes", removedSize)
+
+	// Load metadata of cached images, analyzing images missing from index and collapsing duplicates in background
+	if err := loadImageIndex(); err != nil {
+		exitWithError("Failed to open image index", "error", err)
+	}
+	go func() {
+		indexCachedImages()
+		removed, removedSize := removeDuplicateImages()
+		slog.Info("Removed duplicate images from cache folder", "removed", removed, "bytes", removedSize)
+	}()
 
-	// Initialize last update timestamp
-	timestamp = time.Now().Unix()
+	// Prefetch images and clean up cache in background until shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go prefetchImages(ctx)
+	go runJanitor(ctx)
+	go runCacheListingRefresher(ctx)
+	imageIndexSaved := make(chan struct{})
+	go func() {
+		runImageIndexSaver(ctx)
+		close(imageIndexSaved)
+	}()
 
-	// Start server
-	http.HandleFunc("/", handleRequest)
-	http.HandleFunc("/reload", reloadConfig)
-	log.Println("Listening on port: ", config.ListenPort)
-	log.Fatalln(http.ListenAndServe(":"+strconv.Itoa(config.ListenPort), nil))
+	// Start server, handlers are registered under PathPrefix and see request paths without it
+	mux := http.NewServeMux()
+	mux.Handle(config.PathPrefix+"/", http.StripPrefix(config.PathPrefix, http.HandlerFunc(handleRequest)))
+	mux.Handle(config.PathPrefix+"/version", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveVersion)))
+	mux.Handle(config.PathPrefix+"/healthz", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveHealth)))
+	mux.Handle(config.PathPrefix+"/reload", http.StripPrefix(config.PathPrefix, http.HandlerFunc(reloadConfig)))
+	mux.Handle(config.PathPrefix+"/prefetch", http.StripPrefix(config.PathPrefix, http.HandlerFunc(servePrefetch)))
+	mux.Handle(config.PathPrefix+"/stats", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveStats)))
+	mux.Handle(config.PathPrefix+"/stats/top", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveTopImages)))
+	mux.Handle(config.PathPrefix+"/status", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveStatus)))
+	mux.Handle(config.PathPrefix+"/gallery", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveGallery)))
+	mux.Handle(config.PathPrefix+"/upload", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveUpload)))
+	mux.Handle(config.PathPrefix+"/delete", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveDelete)))
+	mux.Handle(config.PathPrefix+"/purge", http.StripPrefix(config.PathPrefix, http.HandlerFunc(servePurge)))
+	mux.Handle(config.PathPrefix+"/near-duplicates", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveNearDuplicates)))
+	mux.Handle(config.PathPrefix+"/remotes", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveRemotes)))
+	mux.Handle(config.PathPrefix+"/remotes/status", http.StripPrefix(config.PathPrefix, http.HandlerFunc(serveRemoteStatus)))
+	var handler http.Handler = limitRate(limitConcurrency(requireBasicAuth(mux)))
+	if config.AccessLogFileName != "" {
+		accessLogFile, err := openRotatingFile(config.AccessLogFileName, config)
+		if err != nil {
+			exitWithError("Failed to open access log file", "file", config.AccessLogFileName, "error", err)
+		}
+		defer accessLogFile.Close()
+		handler = logAccess(handler, log.New(accessLogFile, "", 0))
+	}
+	handler = withRequestID(handler)
+	// Servers are shut down together, so errors after shutdown started are not reported
+	serverErrors := make(chan error)
+	var servers []*http.Server
+	serve := func(server *http.Server, run func() error) {
+		servers = append(servers, server)
+		go func() {
+			if err := run(); !errors.Is(err, http.ErrServerClosed) {
+				serverErrors <- err
+			}
+		}()
+	}
+	if config.ListenSocket != "" {
+		listener := listenSocket()
+		server := newServer("", handler)
+		slog.Info("Listening on socket", "socket", config.ListenSocket)
+		serve(server, func() error {
+			return server.Serve(listener)
+		})
+	}
+	if config.TLSCertFile != "" {
+		// Fail early on missing or unreadable certificate instead of serving plaintext only
+		if _, err := getTLSCertificate(nil); err != nil {
+			exitWithError("Failed to load TLS certificate", "file", config.TLSCertFile, "error", err)
+		}
+		server := newServer(net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.TLSListenPort)), handler)
+		server.TLSConfig = &tls.Config{GetCertificate: getTLSCertificate}
+		slog.Info("Listening with TLS", "address", server.Addr)
+		serve(server, func() error {
+			return server.ListenAndServeTLS("", "")
+		})
+	}
+	if len(config.ACMEDomains) > 0 {
+		// Challenge listener answers HTTP-01 challenges and redirects everything else to HTTPS
+		manager := newACMEManager()
+		challengeServer := newServer(net.JoinHostPort(config.ListenAddress, strconv.Itoa(ACMEChallengePort)), manager.HTTPHandler(nil))
+		slog.Info("Listening for ACME challenges", "address", challengeServer.Addr)
+		serve(challengeServer, challengeServer.ListenAndServe)
+		server := newServer(net.JoinHostPort(config.ListenAddress, strconv.Itoa(ACMETLSListenPort)), handler)
+		server.TLSConfig = manager.TLSConfig()
+		slog.Info("Listening with ACME certificates", "domains", config.ACMEDomains, "address", server.Addr)
+		serve(server, func() error {
+			return server.ListenAndServeTLS("", "")
+		})
+	}
+	if config.ListenPort != 0 {
+		server := newServer(net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.ListenPort)), handler)
+		slog.Info("Listening", "address", server.Addr)
+		serve(server, server.ListenAndServe)
+	}
+	if config.EnablePprof {
+		// Profiles expose internals, so they get their own listener on localhost instead of the public one
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		server := newServer(net.JoinHostPort("127.0.0.1", strconv.Itoa(config.PprofListenPort)), pprofMux)
+		slog.Info("Listening for pprof", "address", server.Addr)
+		serve(server, server.ListenAndServe)
+	}
+	// A failing listener shuts down the others the same way a signal does, then exits with error
+	var serveErr error
+	select {
+	case serveErr = <-serverErrors:
+		slog.Error("Server failed, shutting down", "error", serveErr)
+		stop()
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+	// Requests in progress get ShutdownTimeoutSeconds to finish, new ones are refused
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shut down server", "address", server.Addr, "error", err)
+		}
+	}
+	<-imageIndexSaved
+	if err := imageIndex.Close(); err != nil {
+		slog.Error("Failed to close image index", "error", err)
+	}
+	if config.ListenSocket != "" {
+		// Closing the listener usually removed the socket already
+		if err := os.Remove(config.ListenSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove socket", "socket", config.ListenSocket, "error", err)
+		} else {
+			slog.Info("Removed socket", "socket", config.ListenSocket)
+		}
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,1352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Config validation warns about every field tests leave unset
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Function for setting up config and global state for a test in a fresh working directory, modify changes the validated config before it is activated
+func setupTest(t testing.TB, remotes []Remote, modify func(config *Config)) *Config {
+	t.Chdir(t.TempDir())
+	config, err := newConfig(Config{Remotes: remotes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mock remotes listen on loopback
+	config.BlockPrivateImageHosts = newBool(false)
+	if modify != nil {
+		modify(&config)
+	}
+	activeConfig.Store(&config)
+	remoteNextFetch = map[string]time.Time{}
+	initHTTPClients()
+	retrievalSlots = make(chan struct{}, config.MaxConcurrentRetrievals)
+	retrievalCalls = map[string]*RetrievalCall{}
+	if err := loadImageIndex(); err != nil {
+		t.Fatal(err)
+	}
+	// Index file name is relative, so changes are saved before leaving the test folder
+	t.Cleanup(saveImageIndex)
+	cachedFilesLock.Lock()
+	cachedFiles = nil
+	cachedFilesLock.Unlock()
+	return &config
+}
+
+// Function for encoding a JPEG of random noise, images of different seeds are never deduplicated
+func newTestJPEG(width int, height int, seed int64) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	source := rand.New(rand.NewSource(seed))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(source.Intn(256)), uint8(source.Intn(256)), uint8(source.Intn(256)), 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Function for starting a mock remote answering with handler, returns it with its number of received requests
+func newTestRemote(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// Function for answering every request with a new JPEG
+func serveTestJPEGs() http.HandlerFunc {
+	var seed atomic.Int64
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(newTestJPEG(64, 48, seed.Add(1)))
+	}
+}
+
+// Function for starting a mock API remote whose /api path links a new JPEG under /img/ on every request after delay, returns URL of /api with number of requests to it and to images
+func newTestAPIRemote(t *testing.T, delay time.Duration) (string, *atomic.Int64, *atomic.Int64) {
+	t.Helper()
+	var apiRequests, imageRequests, seed atomic.Int64
+	images := serveTestJPEGs()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/img/") {
+			imageRequests.Add(1)
+			images(w, r)
+			return
+		}
+		apiRequests.Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<img src="` + server.URL + `/img/` + strconv.FormatInt(seed.Add(1), 10) + `.jpg">`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/api", &apiRequests, &imageRequests
+}
+
+// Function for sending a request to handleRequest, with Accept header if accept is not empty
+func serveTestRequest(method string, target string, accept string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	recorder := httptest.NewRecorder()
+	handleRequest(recorder, request)
+	return recorder
+}
+
+// Function for inserting an APP1 EXIF segment with GPS coordinates after SOI marker of JPEG data
+func addTestGPSExif(data []byte) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	// IFD0 with GPSInfo pointer to GPS IFD at offset 26
+	tiff = append(tiff, 0, 1, 0x88, 0x25, 0, 4, 0, 0, 0, 1, 0, 0, 0, 26, 0, 0, 0, 0)
+	// GPS IFD with GPSLatitudeRef N and GPSLatitude pointing to rationals at offset 56
+	tiff = append(tiff, 0, 2, 0, 1, 0, 2, 0, 0, 0, 2, 'N', 0, 0, 0, 0, 2, 0, 5, 0, 0, 0, 3, 0, 0, 0, 56, 0, 0, 0, 0)
+	// 48/1 51/1 2958/100
+	tiff = append(tiff, 0, 0, 0, 48, 0, 0, 0, 1, 0, 0, 0, 51, 0, 0, 0, 1, 0, 0, 0x0b, 0x8e, 0, 0, 0, 100)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+// Function for checking if JPEG data contains an APP1 EXIF segment before image data
+func hasJPEGExif(data []byte) bool {
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xff && data[offset+1] != 0xda {
+		length := int(data[offset+2])<<8 | int(data[offset+3])
+		if data[offset+1] == 0xe1 && bytes.HasPrefix(data[offset+4:], []byte("Exif\x00\x00")) {
+			return true
+		}
+		offset += 2 + length
+	}
+	return false
+}
+
+func TestRetrievedImageHasNoGPSExif(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		stripMetadata bool
+		exif          bool
+	}{
+		// Re-encoding at default quality is smaller than the original
+		{"compressed", "/", true, false},
+		// Re-encoding at quality 100 is larger, so the original bytes are kept
+		{"original kept", "/?quality=100", true, false},
+		{"opted out", "/?quality=100", false, true},
+	}
+	source := addTestGPSExif(newTestJPEG(64, 48, 1))
+	if !hasJPEGExif(source) {
+		t.Fatal("fixture has no EXIF segment")
+	}
+	if _, _, err := image.Decode(bytes.NewReader(source)); err != nil {
+		t.Fatal("fixture is not decodable:", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote, _ := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Write(source)
+			})
+			setupTest(t, []Remote{{URL: remote.URL + "/gps.jpg"}}, func(config *Config) {
+				config.ServeMode = ServeModeLink
+				config.StripMetadata = newBool(test.stripMetadata)
+			})
+			recorder := serveTestRequest("GET", test.target, "")
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+			}
+			data, err := os.ReadFile(strings.TrimPrefix(recorder.Body.String(), "http://example.com/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hasJPEGExif(data); got != test.exif {
+				t.Errorf("cached image has EXIF = %v, want %v", got, test.exif)
+			}
+		})
+	}
+}
+
+func BenchmarkCompressImage(b *testing.B) {
+	// 8000x6000 photo, as from a modern phone camera
+	data := newTestJPEG(8000, 6000, 1)
+	benchmarks := []struct {
+		name           string
+		maxImagePixels int
+	}{
+		{"original resolution", 0},
+		{"downscaled to 24MP", 24000000},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			setupTest(b, nil, func(config *Config) {
+				config.MaxImagePixels = benchmark.maxImagePixels
+			})
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := compressImage(b.Context(), data, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRootCachesNothingForNonImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"html error page", []byte("<html><body>502 Bad Gateway</body></html>")},
+		{"truncated download", newTestJPEG(64, 48, 1)[:600]},
+		{"empty body", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Remote claims the payload is an image, so only its content gives it away
+			remote, _ := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Write(test.payload)
+			})
+			config := setupTest(t, []Remote{{URL: remote.URL + "/image.jpg", Weight: 1}}, nil)
+			if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d, body %q", recorder.Code, http.StatusBadGateway, recorder.Body.String())
+			}
+			err := filepath.WalkDir(config.CacheFolder, func(path string, entry os.DirEntry, err error) error {
+				if err == nil && !entry.IsDir() {
+					t.Errorf("file %s left in cache folder", path)
+				}
+				return err
+			})
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Function for sending a GET request to handleRequest, with If-None-Match header if etag is not empty
+func serveTestConditionalRequest(target string, etag string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", target, nil)
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	recorder := httptest.NewRecorder()
+	handleRequest(recorder, request)
+	return recorder
+}
+
+func TestCacheETag(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := config.CacheFolder + "/image.jpg"
+	original := newTestJPEG(32, 32, 1)
+	if err := os.WriteFile(filename, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := serveTestConditionalRequest("/cache/image.jpg", "")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", first.Code, http.StatusOK)
+	}
+	etag := first.Header().Get("ETag")
+	if want := `"` + fmt.Sprintf("%x", sha256.Sum256(original)) + `"`; etag != want {
+		t.Fatalf("ETag = %q, want %q", etag, want)
+	}
+
+	notModified := serveTestConditionalRequest("/cache/image.jpg", etag)
+	if notModified.Code != http.StatusNotModified {
+		t.Fatalf("status with matching If-None-Match = %d, want %d", notModified.Code, http.StatusNotModified)
+	}
+	if notModified.Body.Len() != 0 {
+		t.Errorf("304 body has %d bytes, want none", notModified.Body.Len())
+	}
+
+	// Replace file with different content under the same name
+	replaced := newTestJPEG(32, 32, 2)
+	if err := os.WriteFile(filename, replaced, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	changed := serveTestConditionalRequest("/cache/image.jpg", etag)
+	if changed.Code != http.StatusOK {
+		t.Fatalf("status with stale If-None-Match = %d, want %d", changed.Code, http.StatusOK)
+	}
+	newETag := changed.Header().Get("ETag")
+	if want := `"` + fmt.Sprintf("%x", sha256.Sum256(replaced)) + `"`; newETag != want {
+		t.Errorf("ETag after replacing file = %q, want %q", newETag, want)
+	}
+	if !bytes.Equal(changed.Body.Bytes(), replaced) {
+		t.Errorf("body is not the replaced file")
+	}
+	if again := serveTestConditionalRequest("/cache/image.jpg", newETag); again.Code != http.StatusNotModified {
+		t.Errorf("status with new If-None-Match = %d, want %d", again.Code, http.StatusNotModified)
+	}
+}
+
+func TestGetWeightedOrderDistribution(t *testing.T) {
+	setupTest(t, nil, nil)
+	remotes := []Remote{{URL: "http://main", Weight: 8}, {URL: "http://public", Weight: 2}, {URL: "http://fallback", Weight: 0}}
+	const draws = 20000
+	first := map[string]int{}
+	for i := 0; i < draws; i++ {
+		ordered := getWeightedOrder(remotes)
+		if len(ordered) != len(remotes) {
+			t.Fatalf("got %d remotes, want %d", len(ordered), len(remotes))
+		}
+		if ordered[len(ordered)-1].URL != "http://fallback" {
+			t.Fatalf("remote of weight 0 is not last: %v", ordered)
+		}
+		first[ordered[0].URL]++
+	}
+	// Standard deviation of the share is about 0.003 for this many draws
+	for url, want := range map[string]float64{"http://main": 0.8, "http://public": 0.2} {
+		if got := float64(first[url]) / draws; math.Abs(got-want) > 0.02 {
+			t.Errorf("%s picked first in %.3f of draws, want %.2f", url, got, want)
+		}
+	}
+}
+
+func TestZeroWeightRemoteOnlyUsedWhenOthersUnhealthy(t *testing.T) {
+	main, mainRequests := newTestRemote(t, serveTestJPEGs())
+	fallback, fallbackRequests := newTestRemote(t, serveTestJPEGs())
+	mainRemote := Remote{URL: main.URL + "/image", Weight: 1}
+	setupTest(t, []Remote{mainRemote, {URL: fallback.URL + "/image", Weight: 0}}, func(config *Config) {
+		// Main remote is never due again once fetched, which must not make the fallback due instead
+		config.UpdateInterval = 3600
+	})
+	if err := createCacheFolders(t.Context(), ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if filename := cacheRemoteImage(t.Context(), 0, ""); filename == "" {
+			t.Fatal("failed to cache image from main remote")
+		}
+		if hasDueRemote("") {
+			t.Error("remote due right after fetching from main remote")
+		}
+	}
+	if mainRequests.Load() == 0 || fallbackRequests.Load() != 0 {
+		t.Fatalf("main got %d requests, fallback got %d, want fallback unused", mainRequests.Load(), fallbackRequests.Load())
+	}
+
+	// Fallback takes over once main remote is unhealthy
+	for i := 0; i < getActiveConfig().RemoteFailureThreshold; i++ {
+		recordRemoteFailure(mainRemote, errors.New("down"))
+	}
+	requests := mainRequests.Load()
+	if !hasDueRemote("") {
+		t.Error("fallback not due while main remote is unhealthy")
+	}
+	if filename := cacheRemoteImage(t.Context(), 0, ""); filename == "" {
+		t.Fatal("failed to cache image from fallback remote")
+	}
+	if fallbackRequests.Load() == 0 || mainRequests.Load() != requests {
+		t.Errorf("main got %d new requests, fallback got %d, want only fallback used", mainRequests.Load()-requests, fallbackRequests.Load())
+	}
+}
+
+func TestUserAgentArrivesAtRemote(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		headers   map[string]string
+		want      string
+	}{
+		{"default", "", nil, ConfigDefaultUserAgent},
+		{"configured", "TestAgent/1.0", nil, "TestAgent/1.0"},
+		{"remote header takes precedence", "TestAgent/1.0", map[string]string{"User-Agent": "RemoteAgent/2.0"}, "RemoteAgent/2.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			userAgents := map[string]string{}
+			images := serveTestJPEGs()
+			var server *httptest.Server
+			server, _ = newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				userAgents[r.URL.Path] = r.Header.Get("User-Agent")
+				lock.Unlock()
+				if r.URL.Path == "/image.jpg" {
+					images(w, r)
+					return
+				}
+				w.Write([]byte(`{"url": "` + server.URL + `/image.jpg"}`))
+			})
+			setupTest(t, []Remote{{URL: server.URL + "/api", Weight: 1, Headers: test.headers}}, func(config *Config) {
+				if test.userAgent != "" {
+					config.UserAgent = test.userAgent
+				}
+			})
+			if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, path := range []string{"/api", "/image.jpg"} {
+				if got, ok := userAgents[path]; !ok {
+					t.Errorf("remote got no request for %s", path)
+				} else if got != test.want {
+					t.Errorf("User-Agent of request for %s = %q, want %q", path, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// Function for starting a mock API remote answering after delay that records the highest number of API requests it handled at once
+func newTestSlowAPIRemote(t *testing.T, delay time.Duration) (string, *atomic.Int64, *atomic.Int64) {
+	t.Helper()
+	var active, maxActive, seed atomic.Int64
+	images := serveTestJPEGs()
+	var server *httptest.Server
+	server, requests := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/img/") {
+			images(w, r)
+			return
+		}
+		current := active.Add(1)
+		defer active.Add(-1)
+		for {
+			highest := maxActive.Load()
+			if current <= highest || maxActive.CompareAndSwap(highest, current) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		w.Write([]byte(`<img src="` + server.URL + `/img/` + strconv.FormatInt(seed.Add(1), 10) + `.jpg">`))
+	})
+	return server.URL + "/api", requests, &maxActive
+}
+
+func TestRetrievalsBoundedBySemaphore(t *testing.T) {
+	const parallel = 12
+	t.Run("waiting requests", func(t *testing.T) {
+		remoteURL, requests, maxActive := newTestSlowAPIRemote(t, 200*time.Millisecond)
+		config := setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, func(config *Config) {
+			config.MaxConcurrentRetrievals = 2
+		})
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				recorder := serveTestRequest("GET", "/?type=link&quality="+strconv.Itoa(10+i), "")
+				if recorder.Code != http.StatusOK && recorder.Code != http.StatusServiceUnavailable {
+					t.Errorf("status = %d, body %q", recorder.Code, recorder.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		if got := maxActive.Load(); got > int64(config.MaxConcurrentRetrievals) {
+			t.Errorf("remote handled %d retrievals at once, want at most %d", got, config.MaxConcurrentRetrievals)
+		}
+		if requests.Load() < int64(config.MaxConcurrentRetrievals) {
+			t.Errorf("remote got %d requests, want at least %d", requests.Load(), config.MaxConcurrentRetrievals)
+		}
+	})
+	t.Run("background fetches", func(t *testing.T) {
+		remoteURL, _, maxActive := newTestSlowAPIRemote(t, 200*time.Millisecond)
+		config := setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, func(config *Config) {
+			config.MaxConcurrentRetrievals = 2
+		})
+		var busy atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Same call as handleRequest starts in background after serving from cache
+				if _, err := fetchRemoteImage(t.Context(), ImageRequest{Quality: config.ImageQuality, Count: 1}, false); errors.Is(err, ErrRetrievalsBusy) {
+					busy.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := maxActive.Load(); got > int64(config.MaxConcurrentRetrievals) {
+			t.Errorf("remote handled %d retrievals at once, want at most %d", got, config.MaxConcurrentRetrievals)
+		}
+		// Background fetches give up after RetrievalWaitMillis, which is shorter than one retrieval
+		if busy.Load() == 0 {
+			t.Error("no background fetch was skipped while all slots were taken")
+		}
+	})
+}
+
+func TestRootSharesConcurrentRetrieval(t *testing.T) {
+	// Remote answers slowly, so all requests arrive while the first retrieval is in progress
+	remoteURL, apiRequests, imageRequests := newTestAPIRemote(t, 500*time.Millisecond)
+	setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, nil)
+	const callers = 10
+	bodies := make(chan string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := serveTestRequest("GET", "/?type=link", "")
+			if recorder.Code != http.StatusOK {
+				t.Errorf("status = %d, body %q", recorder.Code, recorder.Body.String())
+			}
+			bodies <- recorder.Body.String()
+		}()
+	}
+	wg.Wait()
+	close(bodies)
+	if got := apiRequests.Load(); got != 1 {
+		t.Errorf("remote got %d API requests, want 1", got)
+	}
+	if got := imageRequests.Load(); got != 1 {
+		t.Errorf("remote got %d image requests, want 1", got)
+	}
+	first := ""
+	for body := range bodies {
+		if first == "" {
+			first = body
+		} else if body != first {
+			t.Errorf("body = %q, want link to the single cached image %q", body, first)
+		}
+	}
+}
+
+func TestRootBackgroundFetchKeepsResponse(t *testing.T) {
+	remoteURL, apiRequests, imageRequests := newTestAPIRemote(t, 100*time.Millisecond)
+	setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, nil)
+	if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+
+	// Remote is due again, so the next request is served from cache and fetches in background
+	remoteNextFetchLock.Lock()
+	remoteNextFetch = map[string]time.Time{}
+	remoteNextFetchLock.Unlock()
+	recorder := serveTestRequest("GET", "/?type=link", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	body := recorder.Body.String()
+	deadline := time.Now().Add(5 * time.Second)
+	for imageRequests.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background fetch did not download an image, remote got %d API requests", apiRequests.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Taking every retrieval slot waits for the background fetch to release its one
+	for i := 0; i < cap(retrievalSlots); i++ {
+		if !acquireRetrievalSlot(5 * time.Second) {
+			t.Fatal("background fetch did not finish")
+		}
+	}
+	if got := strings.Count(body, "http://"); got != 1 {
+		t.Errorf("response contains %d URLs, want 1: %q", got, body)
+	}
+	if recorder.Body.String() != body {
+		t.Errorf("response changed after background fetch from %q to %q", body, recorder.Body.String())
+	}
+}
+
+func TestReloadDuringRequests(t *testing.T) {
+	remoteURL, _, _ := newTestAPIRemote(t, 0)
+	config := setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, func(config *Config) {
+		config.AdminToken = "secret"
+		// No background fetches are started that would outlive the test
+		config.UpdateInterval = 3600
+	})
+	writeConfig(*config)
+	if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				recorder := serveTestRequest("GET", "/?type=link", "")
+				if recorder.Code != http.StatusOK {
+					t.Errorf("status during reload = %d, body %q", recorder.Code, recorder.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		// Alternate config values, so every reload replaces config with a different one
+		reloaded := *getActiveConfig()
+		reloaded.ImageQuality = 50 + i%2*20
+		writeConfig(reloaded)
+		request := httptest.NewRequest("GET", "/reload", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		reloadConfig(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("reload status = %d, body %q", recorder.Code, recorder.Body.String())
+		}
+		if got := getActiveConfig().ImageQuality; got != reloaded.ImageQuality {
+			t.Fatalf("ImageQuality after reload = %d, want %d", got, reloaded.ImageQuality)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadKeepsConfigWhenInvalid(t *testing.T) {
+	config := setupTest(t, nil, func(config *Config) {
+		config.AdminToken = "secret"
+	})
+	for name, modify := range map[string]func(config *Config){
+		"proxy": func(config *Config) { config.Proxy = "ftp://proxy.invalid" },
+		"remote": func(config *Config) {
+			config.Remotes = []Remote{{URL: "http://remote.invalid", Proxy: "ftp://proxy.invalid"}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			invalid := *config
+			invalid.ImageQuality = config.ImageQuality + 1
+			modify(&invalid)
+			writeConfig(invalid)
+			request := httptest.NewRequest("GET", "/reload", nil)
+			request.Header.Set("Authorization", "Bearer secret")
+			recorder := httptest.NewRecorder()
+			reloadConfig(recorder, request)
+			if recorder.Code != http.StatusUnprocessableEntity {
+				t.Errorf("reload status = %d, body %q, want %d", recorder.Code, recorder.Body.String(), http.StatusUnprocessableEntity)
+			}
+			if got := getActiveConfig().ImageQuality; got != config.ImageQuality {
+				t.Errorf("ImageQuality after failed reload = %d, want %d", got, config.ImageQuality)
+			}
+		})
+	}
+}
+
+func TestRootRetriesRightAfterFailedFetch(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	images := serveTestJPEGs()
+	remote, requests := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		images(w, r)
+	})
+	setupTest(t, []Remote{{URL: remote.URL + "/image", Weight: 1}}, func(config *Config) {
+		config.UpdateInterval = 3600
+	})
+
+	// Failed fetches must not delay the next attempt by UpdateInterval
+	for i := int64(1); i <= 2; i++ {
+		if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusBadGateway {
+			t.Fatalf("status of failing fetch %d = %d, want %d", i, recorder.Code, http.StatusBadGateway)
+		}
+		if got := requests.Load(); got != i {
+			t.Fatalf("remote got %d requests after failing fetch %d, want %d", got, i, i)
+		}
+	}
+
+	failing.Store(false)
+	if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("status of retry = %d, want %d, body %q", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if requests.Load() <= 2 {
+		t.Fatalf("remote got no request for retry")
+	}
+
+	// Successful fetch delays the next one by UpdateInterval, so the cached image is served without fetching
+	fetched := requests.Load()
+	if recorder := serveTestRequest("GET", "/?type=link", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("status after successful fetch = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if got := requests.Load(); got != fetched {
+		t.Errorf("remote got %d requests after successful fetch, want %d", got, fetched)
+	}
+}
+
+func TestSuccessivePicksDiffer(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const images = 20
+	for i := 0; i < images; i++ {
+		if err := os.WriteFile(config.CacheFolder+"/image"+strconv.Itoa(i)+".jpg", newTestJPEG(8, 8, int64(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Images written by others are indexed once cache folder is listed
+	indexCachedImages()
+	// Rapid-fire picks from parallel goroutines share one random source
+	const goroutines, picks = 4, 200
+	results := make([][]string, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < picks; i++ {
+				results[g] = append(results[g], pickCachedImages(ImageRequest{Count: 1})...)
+			}
+		}()
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for g, result := range results {
+		if len(result) != picks {
+			t.Fatalf("goroutine %d got %d picks, want %d", g, len(result), picks)
+		}
+		repeats := 0
+		for i, filename := range result {
+			seen[filename] = true
+			if i > 0 && filename == result[i-1] {
+				repeats++
+			}
+		}
+		// About picks/images repeats are expected by chance
+		if repeats > 3*picks/images {
+			t.Errorf("goroutine %d picked the same image twice in a row %d times out of %d", g, repeats, picks)
+		}
+	}
+	if len(seen) != images {
+		t.Errorf("picked %d different images, want all %d", len(seen), images)
+	}
+	// Goroutines starting in the same nanosecond must not get the same sequence
+	for g := 1; g < goroutines; g++ {
+		if strings.Join(results[g], ",") == strings.Join(results[0], ",") {
+			t.Errorf("goroutines 0 and %d picked identical sequences", g)
+		}
+	}
+}
+
+func TestDownloadRefusesPrivateAddress(t *testing.T) {
+	config := setupTest(t, nil, func(config *Config) {
+		config.BlockPrivateImageHosts = newBool(true)
+	})
+	initHTTPClients()
+	server, requests := newTestRemote(t, serveTestJPEGs())
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// URL is not checked before, so only the check when dialing stands between download and loopback
+	filename := config.CacheFolder + "/download.jpg"
+	err := downloadFile(t.Context(), filename, server.URL, Remote{URL: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("error = %v, want refused private address", err)
+	}
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Error("refused download left a file behind")
+	}
+	if requests.Load() != 0 {
+		t.Errorf("server got %d requests, want 0", requests.Load())
+	}
+
+	// Proxies may run on private addresses
+	proxy, proxyRequests := newTestRemote(t, serveTestJPEGs())
+	if err := downloadFile(t.Context(), filename, "http://images.invalid/image.jpg", Remote{URL: "http://images.invalid/", Proxy: proxy.URL}); err != nil {
+		t.Errorf("download through proxy: %v", err)
+	}
+	if proxyRequests.Load() != 1 {
+		t.Errorf("proxy got %d requests, want 1", proxyRequests.Load())
+	}
+}
+
+func TestDownloadFileLeavesNoFileOnFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		ok      bool
+	}{
+		{"image", serveTestJPEGs(), true},
+		{"not found", func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }, false},
+		{"non-image body", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>not an image</html>"))
+		}, false},
+		{"connection reset", func(w http.ResponseWriter, r *http.Request) {
+			// Promise more bytes than sent, then reset the connection in the middle of the body
+			conn, buf, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\nContent-Length: 100000\r\n\r\n")
+			buf.Write(newTestJPEG(64, 48, 1)[:1000])
+			buf.Flush()
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0)
+			}
+			conn.Close()
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote, _ := newTestRemote(t, test.handler)
+			setupTest(t, nil, nil)
+			filename := t.TempDir() + string(os.PathSeparator) + "download.jpg"
+			err := downloadFile(t.Context(), filename, remote.URL+"/image.jpg", Remote{})
+			if (err == nil) != test.ok {
+				t.Fatalf("downloadFile error = %v, want success %v", err, test.ok)
+			}
+			_, err = os.Stat(filename)
+			if test.ok && err != nil {
+				t.Errorf("downloaded file missing: %v", err)
+			}
+			if !test.ok && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("failed download left file behind, stat error %v", err)
+			}
+		})
+	}
+}
+
+func TestResizedVariantsAreRoundedUp(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder+"/"+config.CacheTmpFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CacheFolder+"/image.jpg", newTestJPEG(600, 400, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for width := 1; width <= 700; width += 7 {
+		target := "/" + config.CacheFolder + "/image.jpg?w=" + strconv.Itoa(width) + "&h=" + strconv.Itoa(width*2)
+		if recorder := serveTestRequest("GET", target, ""); recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %q", target, recorder.Code, recorder.Body.String())
+		}
+	}
+	entries, err := os.ReadDir(config.CacheFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var variants []string
+	for _, entry := range entries {
+		if isResizedImage(entry.Name()) {
+			variants = append(variants, entry.Name())
+		}
+	}
+	// Widths are rounded up to 64, 128, 256 and 512, larger ones serve the original
+	if len(variants) != 4 {
+		t.Errorf("variants = %v, want 4", variants)
+	}
+}
+
+func TestIsImage(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pngData := bytes.Buffer{}
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     bool
+	}{
+		{"renamed text file", "text.jpg", []byte(strings.Repeat("This is not an image. ", 50)), false},
+		{"real JPEG", "photo.jpg", newTestJPEG(64, 48, 1), true},
+		{"real PNG", "drawing.png", pngData.Bytes(), true},
+		{"zero-byte file", "empty.jpg", nil, false},
+		{"unsupported extension", "photo.txt", newTestJPEG(64, 48, 1), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(config.CacheFolder+"/"+test.filename, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := isImage(test.filename); got != test.want {
+				t.Errorf("isImage(%q) = %v, want %v", test.filename, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPickSkipsNonImageWithoutDeleting(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := config.CacheFolder + "/text.jpg"
+	if err := os.WriteFile(filename, []byte("This is not an image."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if picked := pickCachedImages(ImageRequest{Count: 1}); len(picked) != 0 {
+		t.Errorf("picked %v, want no image", picked)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("non-image file in cache folder was removed: %v", err)
+	}
+}
+
+func TestCacheRejectsPathTraversal(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	secretFolder := t.TempDir()
+	secretFile := secretFolder + string(os.PathSeparator) + "secret.jpg"
+	if err := os.WriteFile(secretFile, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("secret.jpg", []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CacheFolder+"/cached.jpg", newTestJPEG(16, 16, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secretFile, config.CacheFolder+"/link.jpg"); err != nil {
+		t.Skip("Symlinks not supported:", err)
+	}
+	if err := os.Symlink(secretFolder, config.CacheFolder+"/linkdir"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"cached image", "/cache/cached.jpg", http.StatusOK},
+		{"parent folder", "/cache/../secret.jpg", http.StatusNotFound},
+		{"encoded slash", "/cache/..%2fsecret.jpg", http.StatusNotFound},
+		{"encoded dots", "/cache/%2e%2e/secret.jpg", http.StatusNotFound},
+		{"encoded dots and slash", "/cache/%2e%2e%2fsecret.jpg", http.StatusNotFound},
+		{"nested parent folder", "/cache/sub/../../secret.jpg", http.StatusNotFound},
+		{"absolute path", "/cache/" + filepath.ToSlash(secretFile), http.StatusNotFound},
+		{"backslash", "/cache/..%5csecret.jpg", http.StatusNotFound},
+		{"encoded backslash in folder", "/cache/sub%5c..%5c..%5csecret.jpg", http.StatusNotFound},
+		{"null byte", "/cache/cached.jpg%00.jpg", http.StatusNotFound},
+		{"symlink to file outside", "/cache/link.jpg", http.StatusNotFound},
+		{"symlink to folder outside", "/cache/linkdir/secret.jpg", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serveTestRequest("GET", test.target, "")
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if strings.Contains(recorder.Body.String(), "secret") {
+				t.Errorf("body contains file outside cache folder")
+			}
+		})
+	}
+}
+
+func TestGetCachedImageFile(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	outside := t.TempDir()
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks are only resolved for existing files
+	if err := os.WriteFile(outside+"/image.jpg", []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, config.CacheFolder+"/linkdir"); err != nil {
+		t.Skip("Symlinks not supported:", err)
+	}
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"image in cache folder", "image.jpg", true},
+		{"image in subfolder", "remote/image.jpg", true},
+		{"parent folder", "../image.jpg", false},
+		{"parent folder in middle", "remote/../../image.jpg", false},
+		{"current folder", "./image.jpg", false},
+		{"absolute path", filepath.ToSlash(outside) + "/image.jpg", false},
+		{"backslash", "..\\image.jpg", false},
+		{"null byte", "image.jpg\x00.png", false},
+		{"empty part", "remote//image.jpg", false},
+		{"tmp folder", config.CacheTmpFolder + "/image.jpg", false},
+		{"too deep", "a/b/c/image.jpg", false},
+		{"symlink to folder outside", "linkdir/image.jpg", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := getCachedImageFile(test.path); ok != test.ok {
+				t.Errorf("getCachedImageFile(%q) ok = %v, want %v", test.path, ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestRootFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     http.HandlerFunc
+		busy       bool
+		target     string
+		accept     string
+		status     int
+		retryAfter string
+		message    string
+		requests   int64
+	}{
+		{"all remotes failed json", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusInternalServerError) }, false, "/?type=link", "application/json", http.StatusBadGateway, "", ErrAllRemotesFailed.Error(), 1},
+		{"all remotes failed text", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusInternalServerError) }, false, "/?type=link", "", http.StatusBadGateway, "", ErrAllRemotesFailed.Error(), 1},
+		{"remote returns no image", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("<html>nothing here</html>")) }, false, "/?type=link", "application/json", http.StatusBadGateway, "", ErrAllRemotesFailed.Error(), 1},
+		{"retrievals busy json", serveTestJPEGs(), true, "/?type=link", "application/json", http.StatusServiceUnavailable, "5", ErrRetrievalsBusy.Error(), 0},
+		{"retrievals busy text", serveTestJPEGs(), true, "/?type=link&format=text", "application/json", http.StatusServiceUnavailable, "5", ErrRetrievalsBusy.Error(), 0},
+		{"bad parameter json", serveTestJPEGs(), false, "/?orientation=bogus&format=json", "", http.StatusBadRequest, "", "Invalid orientation", 0},
+		{"bad parameter text", serveTestJPEGs(), false, "/?count=-1", "", http.StatusBadRequest, "", "Invalid count", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote, requests := newTestRemote(t, test.remote)
+			setupTest(t, []Remote{{URL: remote.URL + "/image", Weight: 1}}, func(config *Config) {
+				config.RemoteTimeoutSec = 1
+			})
+			if test.busy {
+				// Another retrieval holds every slot while the cache is empty
+				for i := 0; i < cap(retrievalSlots); i++ {
+					retrievalSlots <- struct{}{}
+				}
+			}
+			recorder := serveTestRequest("GET", test.target, test.accept)
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d, body %q", recorder.Code, test.status, recorder.Body.String())
+			}
+			if got := recorder.Header().Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, test.retryAfter)
+			}
+			jsonExpected := strings.Contains(test.target, "format=json") || (test.accept == "application/json" && !strings.Contains(test.target, "format=text"))
+			if jsonExpected {
+				var body map[string]string
+				if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body %q is not json: %v", recorder.Body.String(), err)
+				}
+				if !strings.HasPrefix(body["error"], test.message) {
+					t.Errorf("error = %q, want prefix %q", body["error"], test.message)
+				}
+			} else {
+				if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+					t.Errorf("Content-Type = %q, want text/plain", contentType)
+				}
+				if !strings.HasPrefix(recorder.Body.String(), test.message) {
+					t.Errorf("body = %q, want prefix %q", recorder.Body.String(), test.message)
+				}
+			}
+			if got := requests.Load(); got != test.requests {
+				t.Errorf("remote got %d requests, want %d", got, test.requests)
+			}
+		})
+	}
+}
+
+func TestRootRetrievesFromRemote(t *testing.T) {
+	remoteURL, requests, _ := newTestAPIRemote(t, 0)
+	setupTest(t, []Remote{{URL: remoteURL, Weight: 1}}, nil)
+	recorder := serveTestRequest("GET", "/?type=link", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), "/cache/") {
+		t.Errorf("body = %q, want link to cached image", recorder.Body.String())
+	}
+	if requests.Load() != 1 {
+		t.Errorf("remote got %d requests, want 1", requests.Load())
+	}
+}
+
+func TestPickRemovesExpiredImagesConcurrently(t *testing.T) {
+	config := setupTest(t, nil, func(config *Config) {
+		config.CacheTTLHours = 1
+	})
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const images = 20
+	expiredAt := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < images; i++ {
+		filename := config.CacheFolder + "/image" + strconv.Itoa(i) + ".jpg"
+		if err := os.WriteFile(filename, newTestJPEG(8, 8, int64(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, expiredAt, expiredAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexCachedImages()
+	// Requests and admin deletes run into the same expired images at once
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if picked := pickCachedImages(ImageRequest{Count: 1}); len(picked) != 0 {
+				t.Errorf("picked expired images %v", picked)
+			}
+			deleteCachedImage("image" + strconv.Itoa(g) + ".jpg")
+		}()
+	}
+	wg.Wait()
+	entries, err := os.ReadDir(config.CacheFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			t.Errorf("expired image %s was not removed", entry.Name())
+		}
+	}
+}
+
+func TestListingRefreshUpdatesIndex(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CacheFolder+"/old.jpg", newTestJPEG(8, 8, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	indexCachedImages()
+	// Picks don't touch cache folder, so changes by others are only seen after listing refresh
+	if err := os.Remove(config.CacheFolder + "/old.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CacheFolder+"/new.jpg", newTestJPEG(8, 8, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if picked := pickCachedImages(ImageRequest{Count: 2}); len(picked) != 1 || picked[0] != "old.jpg" {
+		t.Fatalf("picked %v before refresh, want [old.jpg]", picked)
+	}
+	if err := updateCachedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if picked := pickCachedImages(ImageRequest{Count: 2}); len(picked) != 1 || picked[0] != "new.jpg" {
+		t.Fatalf("picked %v after refresh, want [new.jpg]", picked)
+	}
+}
+
+func TestJSONIndexSavesBatches(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(config.CacheFolder+"/image"+strconv.Itoa(i)+".jpg", newTestJPEG(8, 8, int64(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Indexing a batch of images doesn't write index file for each image
+	indexCachedImages()
+	if _, err := os.Stat(config.IndexFileName); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("index file written before save, err = %v", err)
+	}
+	saveImageIndex()
+	data, err := os.ReadFile(config.IndexFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images map[string]ImageInfo
+	if err := json.Unmarshal(data, &images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 5 {
+		t.Errorf("index file has %d images, want 5", len(images))
+	}
+}
+
+func TestSQLiteIndexMigratesJSONIndex(t *testing.T) {
+	config := setupTest(t, nil, nil)
+	if err := os.MkdirAll(config.CacheFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string][2]int{"landscape.jpg": {16, 8}, "portrait.jpg": {8, 16}, "square.jpg": {8, 8}}
+	for filename, size := range sizes {
+		if err := os.WriteFile(config.CacheFolder+"/"+filename, newTestJPEG(size[0], size[1], 1), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Listing indexes the images into json index
+	indexCachedImages()
+	if picked := pickCachedImages(ImageRequest{Count: 1}); len(picked) != 1 {
+		t.Fatalf("picked %v, want one image", picked)
+	}
+	markImagesServed([]string{"square.jpg"})
+	saveImageIndex()
+
+	sqliteConfig := *config
+	sqliteConfig.IndexBackend = IndexBackendSQLite
+	activeConfig.Store(&sqliteConfig)
+	if err := loadImageIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.IndexFileName); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("json index still exists after migration: %v", err)
+	}
+	if _, err := os.Stat(config.IndexFileName + ".migrated"); err != nil {
+		t.Errorf("migrated json index missing: %v", err)
+	}
+	// Migration only runs once, later runs keep using the database
+	if err := loadImageIndex(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		imageIndex.Close()
+	})
+	info, ok := imageIndex.Get("square.jpg")
+	if !ok || info.Width != 8 || info.ServeCount != 1 || info.LastServed.IsZero() {
+		t.Errorf("square.jpg = %+v, %v, want migrated entry served once", info, ok)
+	}
+	if found := imageIndex.Find(ImageFilter{Orientation: OrientationPortrait}); strings.Join(found, ",") != "portrait.jpg" {
+		t.Errorf("Find(portrait) = %v, want [portrait.jpg]", found)
+	}
+	if found := imageIndex.Find(ImageFilter{Category: "other"}); len(found) != 0 {
+		t.Errorf("Find(category other) = %v, want none", found)
+	}
+	if oldest := imageIndex.Oldest(3); len(oldest) != 3 || oldest[2] != "square.jpg" {
+		t.Errorf("Oldest(3) = %v, want square.jpg served last", oldest)
+	}
+	if sample := imageIndex.Sample(ImageFilter{}, 3, func(filename string) bool { return filename == "landscape.jpg" }); len(sample) != 2 || containsString(sample, "landscape.jpg") {
+		t.Errorf("Sample excluding landscape.jpg = %v", sample)
+	}
+	if picked := pickCachedImages(ImageRequest{Count: 1, Orientation: OrientationLandscape}); strings.Join(picked, ",") != "landscape.jpg" {
+		t.Errorf("picked %v, want [landscape.jpg]", picked)
+	}
+	if _, err := removeCachedImage("landscape.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := imageIndex.Get("landscape.jpg"); ok {
+		t.Error("removed image is still indexed")
+	}
+}
+
+func TestPrefetchStopsWhenContextDone(t *testing.T) {
+	remote, requests := newTestRemote(t, serveTestJPEGs())
+	setupTest(t, []Remote{{URL: remote.URL + "/image.jpg"}}, nil)
+	if result := prefetchImageBatch(context.Background(), 3, func(result PrefetchResult) {}); result.Succeeded != 3 {
+		t.Fatalf("prefetch result = %+v, want 3 succeeded", result)
+	}
+	// Cancelled request gives up remaining images without fetching them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fetched := requests.Load()
+	if result := prefetchImageBatch(ctx, 3, func(result PrefetchResult) {}); result.Skipped != 3 {
+		t.Errorf("prefetch result after cancel = %+v, want 3 skipped", result)
+	}
+	if got := requests.Load(); got != fetched {
+		t.Errorf("remote got %d requests after cancel, want %d", got, fetched)
+	}
+}
+
+func TestPrefetchStreamsProgress(t *testing.T) {
+	remote, _ := newTestRemote(t, serveTestJPEGs())
+	setupTest(t, []Remote{{URL: remote.URL + "/image.jpg"}}, func(config *Config) {
+		config.AdminToken = "secret"
+	})
+	request := httptest.NewRequest("POST", "/prefetch?count=3", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	servePrefetch(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", recorder.Code, recorder.Body.String())
+	}
+	// One line per image, then the summary
+	var results []PrefetchResult
+	decoder := json.NewDecoder(recorder.Body)
+	for decoder.More() {
+		var result PrefetchResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d lines, want 4", len(results))
+	}
+	if summary := results[3]; summary.Requested != 3 || summary.Succeeded != 3 {
+		t.Errorf("summary = %+v, want 3 requested and succeeded", summary)
+	}
+}
+
+func TestRequestSlotsResizeOnReload(t *testing.T) {
+	setupTest(t, nil, func(config *Config) {
+		config.MaxQueuedRequests = 0
+	})
+	setRequestSlots(1)
+	t.Cleanup(func() { setRequestSlots(0) })
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		return recorder
+	}
+	done := make(chan struct{})
+	go func() {
+		serve()
+		close(done)
+	}()
+	<-started
+	if recorder := serve(); recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status with all slots taken = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	// Larger limit applies to new requests while the old one still runs
+	setRequestSlots(2)
+	second := make(chan struct{})
+	go func() {
+		serve()
+		close(second)
+	}()
+	<-started
+	close(release)
+	<-done
+	<-second
+}